@@ -1,3 +1,3 @@
 #!/bin/sh
 
-docker build -t mrbuk/gcs-compressor:0.2 .
+docker build --build-arg VERSION=0.2 --build-arg COMMIT=$(git rev-parse --short HEAD) -t mrbuk/gcs-compressor:0.2 .
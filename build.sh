@@ -1,3 +1,3 @@
 #!/bin/sh
 mkdir -p build
-go build -o build -v ./...
\ No newline at end of file
+go build -o build -ldflags "-X main.commit=$(git rev-parse --short HEAD) -X main.date=$(date -u +%Y-%m-%dT%H:%M:%SZ)" -v ./...
\ No newline at end of file
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/mrbuk/gcs-compressor/core"
+)
+
+// command is a subcommand with its own flag set made up of flag groups
+type command struct {
+	name        string
+	description string
+	flags       []func(fs *flag.FlagSet)
+}
+
+var commands = []command{
+	{"compress", "compress a single object, or a local file", []func(*flag.FlagSet){storageFlags, destinationFlags, compressionFlags, sourceObjectFlags, destinationObjectFlags, localFlags, reportFlags}},
+	{"decompress", "decompress a single GZIP compressed object", []func(*flag.FlagSet){storageFlags, destinationFlags, sourceObjectFlags, destinationObjectFlags, reportFlags}},
+	{"bulk", "compress each object under a prefix or matching a glob", []func(*flag.FlagSet){storageFlags, destinationFlags, compressionFlags, prefixFlags, globFlags, listFlags, bulkFlags, reportFlags}},
+	{"archive", "bundle all objects under a prefix into a single tar.gz", []func(*flag.FlagSet){storageFlags, destinationFlags, compressionFlags, prefixFlags, listFlags, destinationObjectFlags, reportFlags}},
+	{"serve", "compress objects of storage notifications received via PubSub", []func(*flag.FlagSet){storageFlags, destinationFlags, compressionFlags, prefixFlags, eventFlags}},
+}
+
+// flagGroups are all flag groups, which make up the flat flag set
+var flagGroups = []func(*flag.FlagSet){storageFlags, destinationFlags, compressionFlags, sourceObjectFlags, destinationObjectFlags, localFlags, reportFlags, prefixFlags, globFlags, listFlags, bulkFlags, eventFlags}
+
+// mode is the command to run. Without a command it is derived from the flat flags
+var mode string
+
+// parseCommand parses the flags of the command given as first argument. The flag set of
+// the command replaces flag.CommandLine, so usage and errors refer to its flags only
+func parseCommand(args []string) {
+	for _, cmd := range commands {
+		if cmd.name != args[0] {
+			continue
+		}
+
+		if flag.NFlag() > 0 {
+			fmt.Fprintf(flag.CommandLine.Output(), "error:	flags need to be provided after the command '%s'\n\n", cmd.name)
+			flag.Usage()
+			os.Exit(1)
+		}
+
+		fs := flag.NewFlagSet("gcs-compressor "+cmd.name, flag.ExitOnError)
+		for _, register := range cmd.flags {
+			register(fs)
+		}
+		flag.CommandLine = fs
+		fs.Parse(args[1:])
+
+		if fs.NArg() > 0 {
+			fmt.Fprintf(fs.Output(), "error:	unexpected arguments %v\n\n", fs.Args())
+			fs.PrintDefaults()
+			os.Exit(1)
+		}
+		mode = cmd.name
+		return
+	}
+
+	fmt.Fprintf(flag.CommandLine.Output(), "error:	unknown command '%s'\n\n", args[0])
+	flag.Usage()
+	os.Exit(1)
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: gcs-compressor <command> [flags]\n\nCommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(out, "  %-12s%s\n", cmd.name, cmd.description)
+	}
+	fmt.Fprintf(out, "\nRun 'gcs-compressor <command> -h' for the flags of a command. Without a command the mode is\nderived from the following flags:\n\n")
+	flag.PrintDefaults()
+}
+
+func storageFlags(fs *flag.FlagSet) {
+	fs.StringVar(&sourceBucketName, "sourceBucket", "", "name of bucket to read from: e.g. gcs-source-bucket [required]")
+	fs.StringVar(&destinationBucketName, "destinationBucket", "", "name of bucket to write to: e.g. gcs-destination bucket. A comma-separated list writes the object to each bucket, e.g. for replicas in other regions. Entries source=destination map source buckets to their destination in serve mode [required]")
+	fs.StringVar(&sourceProject, "sourceProject", "", "Google Cloud project used as quota project when accessing the source bucket. Defaults to the ambient project")
+	fs.StringVar(&destinationProject, "destinationProject", "", "Google Cloud project used as quota project when accessing the destination bucket. Defaults to the ambient project")
+	fs.StringVar(&userProject, "userProject", "", "Google Cloud project billed for requests to source and destination bucket, required for requester-pays buckets")
+	fs.StringVar(&credentialsFile, "credentialsFile", "", "service account key file the storage and pubsub clients authenticate with. Defaults to Application Default Credentials")
+	fs.StringVar(&impersonateAccount, "impersonateServiceAccount", "", "service account the storage and pubsub clients impersonate: e.g. compressor@project.iam.gserviceaccount.com. Requires roles/iam.serviceAccountTokenCreator")
+	fs.StringVar(&otlpEndpoint, "otlpEndpoint", os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"), "OTLP/HTTP endpoint traces are exported to: e.g. http://localhost:4318/v1/traces. Tracing is disabled if empty")
+}
+
+func destinationFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&probeDestination, "probeDestination", false, fmt.Sprintf("check at startup that the destination bucket is writable by writing and deleting the object '%s'", core.ProbeObjectName))
+	fs.BoolVar(&preserveCustomTime, "preserveCustomTime", false, "set the custom time of destination objects to the custom time or else the creation time of the source object, e.g. for lifecycle rules based on custom time")
+	fs.BoolVar(&temporaryHold, "temporaryHold", false, "place a temporary hold on destination objects")
+	fs.BoolVar(&eventBasedHold, "eventBasedHold", false, "place an event-based hold on destination objects")
+	fs.StringVar(&onExisting, "onExisting", string(core.OnExistingError), "handling of existing destination objects: error fails, skip skips the object and keeps the source, e.g. for redelivered events, overwrite replaces it")
+	fs.BoolVar(&overwrite, "overwrite", false, "deprecated: use -onExisting overwrite")
+	fs.StringVar(&metadataRoutes, "metadataRoutes", "", "comma-separated list of key=value:bucket routes writing source objects with custom metadata key=value to another destination bucket: e.g. archive-tier=cold:cold-bucket. The first match applies")
+	fs.BoolVar(&appendDestination, "append", false, "compress the source and append it to the destination object, creating it if absent. For rolling logs")
+	fs.BoolVar(&inPlace, "inPlace", false, "replace source objects by their compressed version under the same name. Requires the same -sourceBucket and -destinationBucket")
+	fs.IntVar(&chunkSize, "chunkSize", 0, "size in bytes of the chunks of resumable uploads: e.g. 67108864. Each in-flight upload buffers one chunk in memory. 0 = client default of 16 MiB")
+	fs.StringVar(&destinationContentType, "destinationContentType", "", "content type of the destination object. Defaults to the content type of the source object")
+	fs.StringVar(&storageClass, "destinationStorageClass", "", fmt.Sprintf("storage class of the destination object: one of %s. Defaults to the default storage class of the destination bucket", strings.Join(storageClasses, ", ")))
+	fs.StringVar(&destinationACL, "destinationACL", "", fmt.Sprintf("predefined ACL applied to the destination object: one of %s. Defaults to the default object ACL of the destination bucket", strings.Join(predefinedACLs, ", ")))
+	fs.StringVar(&kmsKey, "kmsKey", "", "Cloud KMS key used to encrypt the destination object: e.g. projects/p/locations/l/keyRings/r/cryptoKeys/k. Defaults to the encryption of the destination bucket")
+}
+
+func compressionFlags(fs *flag.FlagSet) {
+	fs.StringVar(&codecName, "codec", core.DefaultCodec.Name, "codec used to compress objects, see -listCodecs. Objects written with codecs without standard content encoding, e.g. snappy, get a 'compression-codec' metadata marker and the codec extension as default -destinationSuffix")
+	fs.BoolVar(&setContentEncoding, "setContentEncoding", true, "set Content-Encoding of the codec on destination objects, so GCS decompresses them on download for clients not accepting the encoding. Without it objects are served compressed as is and marked with 'compression-codec' metadata")
+	fs.StringVar(&levelBySize, "levelBySize", "", "compression levels by object size as ascending size:level thresholds: e.g. 1MB:1,100MB:6,+:9. Objects larger than all thresholds without + use -compressionLevel")
+	fs.IntVar(&compressionLevel, "compressionLevel", gzip.DefaultCompression, "NoCompression = 0, BestSpeed = 1, BestCompression = 9, DefaultCompression = -1, HuffmanOnly = -2")
+	fs.IntVar(&parallelChunks, "parallelChunks", 1, fmt.Sprintf("experimental: number of byte ranges of an object compressed in parallel and composed into the destination (1-%d). 1 = single stream", core.MaxParallelChunks))
+	fs.IntVar(&downloadParallelism, "downloadParallelism", 1, fmt.Sprintf("number of %d MiB byte ranges of an object downloaded concurrently into the single compression stream. 1 = single download stream", core.DownloadPartSize>>20))
+	fs.IntVar(&gzipBufferSize, "gzipBufferSize", 0, "size in bytes of the buffer between the GZIP writer and the GCS writer: e.g. 1048576. 0 = unbuffered")
+	fs.StringVar(&destinationTemplate, "destinationTemplate", "", "template of the name of destination objects derived from the source object: e.g. compressed/{date}/{dir}/{name}. Supports {object}, {dir}, {name}, {ext} and {date}, the creation date of the source object. -destinationSuffix is appended")
+	fs.BoolVar(&partitionByDate, "partitionByDate", false, "prepend a Hive-style partition of the creation date of the source object to destination names: e.g. year=2024/month=01/day=31/")
+	fs.StringVar(&destinationSuffix, "destinationSuffix", "", "suffix appended to the name of destination objects: e.g. .gz")
+	fs.Int64Var(&minSize, "minSize", 0, "minimum size in bytes of an object to be compressed. Smaller objects are skipped")
+	fs.BoolVar(&skipEmpty, "skipEmpty", false, "skip empty objects instead of copying them uncompressed to the destination bucket")
+	fs.Int64Var(&maxSize, "maxSize", 0, "maximum size in bytes of an object to be compressed. Larger objects fail and are dead-lettered, if configured. 0 = unlimited")
+	fs.BoolVar(&copySmallFiles, "copySmallFiles", false, "copy objects smaller than -minSize uncompressed to the destination bucket instead of skipping them")
+	fs.StringVar(&compressContentTypes, "compressContentTypes", "", "comma-separated list of content types of source objects that are compressed, others are skipped and kept: e.g. text/*,application/json. Empty = all content types")
+	fs.StringVar(&skipContentTypes, "skipContentTypes", "", "comma-separated list of content types of source objects that are skipped and kept: e.g. image/*,video/*")
+	fs.StringVar(&copyExtensions, "copyExtensions", "", "comma-separated list of extensions of already compressed objects that are copied uncompressed to the destination bucket: e.g. .gz,.zip,.jpg,.mp4")
+	fs.Float64Var(&minRatio, "minRatio", 0, "minimum compression ratio worth keeping the compressed object: e.g. 1.05. Below it the destination is deleted and the source kept uncompressed. 0 keeps all")
+	fs.BoolVar(&deleteOnInflation, "deleteOnInflation", false, "delete the source object even if the compressed object is not smaller. By default such a source is kept")
+	fs.BoolVar(&computeRatio, "computeRatio", true, "read the destination object after writing it to log its size and the compression ratio. Disable to save a request per object")
+	fs.IntVar(&notFoundRetries, "notFoundRetries", 0, "retries opening a source object that is not found, e.g. as it is not yet visible right after its upload. 0 = fail immediately")
+	fs.DurationVar(&notFoundDelay, "notFoundDelay", time.Second, "delay between retries of -notFoundRetries")
+	fs.BoolVar(&passthroughEncoded, "passthroughEncoded", true, "copy source objects uploaded with a Content-Encoding, e.g. pre-compressed with gzip, as is instead of compressing them again")
+	fs.StringVar(&gzipHeaderName, "gzipHeaderName", "", "template of the name written to GZIP headers, with the placeholders of -destinationTemplate: e.g. {name}. Empty by default")
+	fs.StringVar(&gzipHeaderComment, "gzipHeaderComment", "", "comment written to GZIP headers. Empty by default")
+	fs.BoolVar(&deterministic, "deterministic", false, "write GZIP headers without modification time, name and OS, even with -gzipHeaderName, so identical inputs yield byte-identical objects")
+	fs.BoolVar(&tagProducer, "tagProducer", false, "store host name and worker name as 'compressed-by' metadata on the destination object")
+	fs.BoolVar(&storeSourceChecksums, "storeSourceChecksums", false, "store CRC32C and MD5 of the source object as 'src-crc32c' and 'src-md5' metadata on the destination object to verify its decompressed content")
+	fs.BoolVar(&storeOriginalSize, "storeOriginalSize", false, "store size and CRC32C of the uncompressed source object as 'uncompressed-size' and 'uncompressed-crc32c' metadata on the destination object")
+}
+
+func sourceObjectFlags(fs *flag.FlagSet) {
+	fs.StringVar(&sourceObjectName, "sourceObjectName", "", "name of the source object [compress, decompress]")
+	fs.Int64Var(&sourceGeneration, "sourceGeneration", 0, "generation of the source object in a versioned bucket. Only this generation is deleted afterwards. 0 = live version [compress, decompress]")
+}
+
+func destinationObjectFlags(fs *flag.FlagSet) {
+	fs.StringVar(&destinationObjectName, "destinationObjectName", "", "name of the destination object. Defaults to the name of the source object [compress, decompress, archive]")
+}
+
+func localFlags(fs *flag.FlagSet) {
+	fs.StringVar(&localInput, "localInput", "", "local file to compress instead of a source object, - = stdin. Requires -localOutput [compress]")
+	fs.StringVar(&localOutput, "localOutput", "", "local file the compressed output is written to instead of a destination object, - = stdout. Requires -localInput [compress]")
+}
+
+func reportFlags(fs *flag.FlagSet) {
+	fs.StringVar(&logFile, "logFile", "", "file the log is appended to in addition to stderr [compress, decompress, bulk, archive]")
+	fs.StringVar(&reportFile, "reportFile", "", "file the summary of the run is written to as JSON [compress, decompress, bulk, archive]")
+}
+
+func prefixFlags(fs *flag.FlagSet) {
+	fs.StringVar(&sourcePrefix, "sourcePrefix", "", "prefix of source objects compressed [bulk] or bundled into a single tar.gz archive written to -destinationObjectName [archive]. Only events for objects with this prefix are processed [serve]")
+}
+
+func globFlags(fs *flag.FlagSet) {
+	fs.StringVar(&sourceGlob, "sourceGlob", "", "glob of source objects compressed instead of all objects under -sourcePrefix: e.g. logs/2024-*/*.json. * does not match / [bulk]")
+	fs.StringVar(&objectList, "objectList", "", "local file or gs://bucket/object listing the source objects compressed, one per line. Blank lines and lines starting with # are ignored [bulk]")
+	fs.BoolVar(&allowEmpty, "allowEmpty", false, "succeed if -sourceGlob matches no objects instead of failing [bulk]")
+}
+
+func listFlags(fs *flag.FlagSet) {
+	fs.StringVar(&modifiedAfter, "modifiedAfter", "", "only include objects modified after the given RFC3339 timestamp: e.g. 2024-01-01T00:00:00Z [bulk, archive]")
+}
+
+func bulkFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&perObjectTimeout, "perObjectTimeout", 0, "time compressing and deleting a single object may take before it is counted as failure, while the run continues: e.g. 10m. 0 is unlimited [bulk]")
+	fs.BoolVar(&continueOnError, "continueOnError", true, "count failing objects and continue with the others. Without it the first failure stops the run. Exits non-zero if any object failed [bulk]")
+	fs.BoolVar(&includeNoncurrent, "includeNoncurrent", false, "compress the noncurrent versions under -sourcePrefix of a versioned bucket to '<object>.<generation>' instead of the live objects, deleting only the compressed version [bulk]")
+	fs.StringVar(&manifestName, "manifest", "", "object in the destination bucket a manifest of all compressed objects is written to as newline-delimited JSON [bulk]")
+}
+
+func eventFlags(fs *flag.FlagSet) {
+	fs.IntVar(&workflowRetries, "workflowRetries", 0, "in-process retries of a compression failing with a transient error before the message is republished or dead-lettered [serve]")
+	fs.StringVar(&subscriptionName, "subscription", "", "name of the PubSub subscription to listen for storage notifications [serve]")
+	fs.StringVar(&topicName, "topic", "", "name of the PubSub topic used to republish messages in case of a shutdown mid-processing [serve]")
+	fs.StringVar(&deadLetterTopicName, "deadLetterTopic", "", "name of the PubSub topic messages of permanently failing objects are published to, e.g. after exceeding -maxRedeliveries [serve]")
+	fs.IntVar(&maxRedeliveries, "maxRedeliveries", 0, "maximum number of times a message is republished before it is sent to -deadLetterTopic. 0 = unlimited [serve]")
+	fs.StringVar(&resultTopicName, "resultTopic", "", "name of the PubSub topic a result message is published to for each compressed object [serve]")
+	fs.BoolVar(&ackAfterProcessing, "ackAfterProcessing", false, "acknowledge messages only after the object has been processed, extending the lease meanwhile. Failed messages are dead-lettered, if configured, or redelivered by PubSub [serve]")
+	fs.IntVar(&maxOutstandingMessages, "maxOutstandingMessages", 0, "maximum number of messages pulled but not yet settled, e.g. the number of workers. 0 = client default of 1000 [serve]")
+	fs.DurationVar(&maxExtension, "maxExtension", 0, "maximum time the lease of a pulled message is extended. 0 = client default of 60m [serve]")
+	fs.Float64Var(&maxObjectsPerSecond, "maxObjectsPerSecond", 0, "maximum number of objects workers start to compress per second, e.g. 0.5. 0 = unlimited [serve]")
+	fs.DurationVar(&shutdownGracePeriod, "shutdownGracePeriod", 3*time.Second, "time in-flight jobs are given to finish on shutdown before they are canceled and republished [serve]")
+	fs.DurationVar(&republishTimeout, "republishTimeout", 5*time.Second, "timeout for publishing a message to the republish, dead-letter or result topic [serve]")
+	fs.StringVar(&projectId, "projectId", pubsub.DetectProjectID, "Google Cloud project id used for the PubSub client [serve]")
+	fs.StringVar(&includeExtensions, "includeExtensions", "", "comma-separated list of object name extensions to compress: e.g. .csv,.json. Empty = all extensions [serve]")
+	fs.StringVar(&statusAddr, "statusAddr", "", "address the admin endpoints are served on: e.g. :8080. /status lists in-flight objects, POST /compress enqueues an object. Disabled if empty [serve]")
+	fs.StringVar(&statusToken, "statusToken", os.Getenv("STATUS_TOKEN"), "bearer token required by the admin endpoints. Defaults to $STATUS_TOKEN, no token if empty [serve]")
+	fs.StringVar(&ignoredEventAction, "ignoredEventAction", IGNORED_EVENT_ACK, "settlement of messages of ignored events, e.g. of other buckets, temporary objects or other event types: ack drops them, nack leaves them to other subscribers or redelivery [serve]")
+	fs.StringVar(&eventTypes, "eventTypes", "OBJECT_FINALIZE", "comma-separated list of storage notification event types that trigger compression: e.g. OBJECT_FINALIZE,OBJECT_METADATA_UPDATE [serve]")
+}
@@ -0,0 +1,105 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+// AppendRetries is the number of times appending to a destination object is retried when
+// another writer appended to it concurrently
+const AppendRetries = 10
+
+// compressAppend compresses the source object to a temporary object and composes it onto
+// the end of the destination object, creating the destination if absent. As GZIP members
+// (and snappy streams) can be concatenated, the destination stays a valid stream
+func (c *Workflow) compressAppend(ctx context.Context, srcObjectAttrs *storage.ObjectAttrs, srcReader io.Reader, start time.Time) (Result, error) {
+	workerName := GetWorkerName(ctx)
+
+	// concurrent appends of other sources to the same destination use other temporary objects
+	target := c.dstObject
+	name := fmt.Sprintf("%s%sappend-%08x-%d", target.ObjectName(), TempPartMarker, crc32.ChecksumIEEE([]byte(c.srcObject.ObjectName())), srcObjectAttrs.Generation)
+	temp := c.dstBucket(target.BucketName()).Object(name)
+	c.dstObject = temp
+	defer func() { c.dstObject = target }()
+	defer c.deleteParts(ctx, []*storage.ObjectHandle{temp})
+
+	level := c.objectCompressionLevel(ctx, srcObjectAttrs)
+	reader := c.sourceReader(ctx, srcObjectAttrs, srcReader)
+	bytesProcessed, err := c.compressStream(ctx, srcObjectAttrs, reader, level)
+	reader.Close()
+	if err != nil {
+		return Result{}, err
+	}
+
+	tempAttrs, err := temp.Attrs(ctx)
+	if err != nil {
+		return Result{}, accessError(fmt.Errorf("failed to read temporary object metadata: %w", err), opReadDestination, temp.BucketName())
+	}
+
+	if err := c.appendTo(ctx, target, temp.Generation(tempAttrs.Generation), tempAttrs, c.customTime(srcObjectAttrs)); err != nil {
+		return Result{}, err
+	}
+
+	var compressionRatio float64
+	if tempAttrs.Size > 0 {
+		compressionRatio = float64(srcObjectAttrs.Size) / float64(tempAttrs.Size)
+	}
+	c.inflated = tempAttrs.Size >= srcObjectAttrs.Size
+	elapsed := time.Since(start)
+	log.Printf("%s - '%s' compressed %d bytes to %d bytes appended to %s/%s with %s level %d. Compression ratio %.2f. Took %s", workerName, c.srcObject.ObjectName(), bytesProcessed, tempAttrs.Size, target.BucketName(), target.ObjectName(), c.codec().Name, level, compressionRatio, elapsed.Round(time.Millisecond))
+
+	return Result{
+		BytesIn:  bytesProcessed,
+		BytesOut: tempAttrs.Size,
+		Ratio:    compressionRatio,
+		Codec:    c.codec().Name,
+		Duration: elapsed,
+	}, nil
+}
+
+// appendTo composes part onto the end of target, or creates target from part and customTime
+// if absent. Generation preconditions make a concurrent append fail, which is then retried
+// on the new generation, so no append is lost
+func (c *Workflow) appendTo(ctx context.Context, target, part *storage.ObjectHandle, partAttrs *storage.ObjectAttrs, customTime time.Time) error {
+	for attempt := 0; ; attempt++ {
+		var composer *storage.Composer
+		attrs, err := target.Attrs(ctx)
+		switch {
+		case errors.Is(err, storage.ErrObjectNotExist):
+			composer = target.If(storage.Conditions{DoesNotExist: true}).ComposerFrom(part)
+			attrs = &storage.ObjectAttrs{ContentType: partAttrs.ContentType, ContentEncoding: partAttrs.ContentEncoding, Metadata: partAttrs.Metadata, CustomTime: customTime}
+		case err != nil:
+			return accessError(fmt.Errorf("failed to read destination object metadata: %w", err), opReadDestination, target.BucketName())
+		default:
+			composer = target.If(storage.Conditions{GenerationMatch: attrs.Generation}).ComposerFrom(target.Generation(attrs.Generation), part)
+		}
+		// compose does not keep the attributes of the sources
+		composer.ContentType = attrs.ContentType
+		composer.ContentEncoding = attrs.ContentEncoding
+		composer.Metadata = attrs.Metadata
+		composer.CustomTime = attrs.CustomTime
+		composer.KMSKeyName = c.options.KMSKeyName
+		composer.PredefinedACL = c.options.PredefinedACL
+		composer.StorageClass = c.options.StorageClass
+
+		_, err = composer.Run(ctx)
+		var apiErr *googleapi.Error
+		if errors.As(err, &apiErr) && apiErr.Code == http.StatusPreconditionFailed && attempt < AppendRetries {
+			log.Printf("%s - '%s' destination object '%s/%s' changed while appending, retrying", GetWorkerName(ctx), c.srcObject.ObjectName(), target.BucketName(), target.ObjectName())
+			continue
+		}
+		if err != nil {
+			return accessError(fmt.Errorf("failed to append to destination object: %w", err), opWriteDestination, target.BucketName())
+		}
+		return nil
+	}
+}
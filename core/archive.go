@@ -0,0 +1,196 @@
+package core
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// Archiver bundles all objects under a prefix into a single GZIP compressed tar archive
+type Archiver struct {
+	client           *storage.Client
+	dstClient        *storage.Client
+	srcBucket        *storage.BucketHandle
+	srcPrefix        string
+	dstObject        *storage.ObjectHandle
+	compressionLevel int
+	options          Options
+}
+
+// ArchiveResult describes the outcome of a successful Archive
+type ArchiveResult struct {
+	Result
+	// Objects is the number of objects added to the archive
+	Objects int
+	// Skipped is the number of listed objects not added to the archive
+	Skipped int
+}
+
+func NewArchiver(ctx context.Context, compressionLevel int, sourceBucketName, sourcePrefix, destinationBucketName, destinationObjectName string, options Options) (*Archiver, error) {
+	a := &Archiver{}
+
+	a.compressionLevel = compressionLevel
+	a.options = options
+	a.srcPrefix = sourcePrefix
+
+	var err error
+	if a.client, a.dstClient, err = newClients(ctx, options); err != nil {
+		return nil, err
+	}
+
+	a.srcBucket = a.client.Bucket(sourceBucketName).UserProject(options.UserProject)
+	a.dstObject = a.dstClient.Bucket(destinationBucketName).UserProject(options.UserProject).Object(destinationObjectName)
+
+	return a, nil
+}
+
+func (a *Archiver) Close() {
+	closeClients(a.client, a.dstClient)
+}
+
+// Archive streams all objects under the source prefix into a tar archive that is written
+// GZIP compressed to the destination object. Objects are named relative to the prefix
+// within the archive. Source objects are not deleted
+func (a *Archiver) Archive(ctx context.Context) (ArchiveResult, error) {
+	workerName := GetWorkerName(ctx)
+	start := time.Now()
+
+	if _, err := a.dstObject.Attrs(ctx); err == nil && a.options.OnExisting != OnExistingOverwrite {
+		return ArchiveResult{}, existingError(a.options.OnExisting)
+	}
+
+	// canceling the writer context aborts the upload. This ensures that a
+	// failed archive does not finalize a truncated destination object
+	wctx, wcancel := context.WithCancel(ctx)
+	defer wcancel()
+
+	dstWriter := a.dstObject.NewWriter(wctx)
+	abort := func(err error) (ArchiveResult, error) {
+		wcancel()
+		dstWriter.Close()
+		return ArchiveResult{}, err
+	}
+
+	dstWriter.ContentType = "application/x-tar"
+	if a.options.ContentType != "" {
+		dstWriter.ContentType = a.options.ContentType
+	}
+	dstWriter.ContentEncoding = "gzip"
+	dstWriter.KMSKeyName = a.options.KMSKeyName
+	dstWriter.PredefinedACL = a.options.PredefinedACL
+	dstWriter.TemporaryHold = a.options.TemporaryHold
+	dstWriter.EventBasedHold = a.options.EventBasedHold
+	dstWriter.StorageClass = a.options.StorageClass
+	if a.options.ChunkSize > 0 {
+		dstWriter.ChunkSize = a.options.ChunkSize
+	}
+
+	gzipWriter, err := gzip.NewWriterLevel(dstWriter, a.compressionLevel)
+	if err != nil {
+		return abort(fmt.Errorf("failed to create GZIP writer: %w", err))
+	}
+	tarWriter := tar.NewWriter(gzipWriter)
+
+	log.Printf("%s - archiving objects with prefix '%s' from bucket '%s' to '%s/%s'", workerName, a.srcPrefix, a.srcBucket.BucketName(), a.dstObject.BucketName(), a.dstObject.ObjectName())
+
+	// objects are listed page by page and streamed one at a time, so
+	// arbitrarily large numbers of objects are never held in memory
+	var objects, skipped int
+	var bytesIn int64
+	it := a.srcBucket.Objects(ctx, &storage.Query{Prefix: a.srcPrefix})
+	for {
+		attrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			return abort(fmt.Errorf("failed to list source objects: %w", err))
+		}
+
+		name := strings.TrimPrefix(strings.TrimPrefix(attrs.Name, a.srcPrefix), "/")
+		// skip folder placeholders, temporary parts and the archive itself
+		if name == "" || strings.HasSuffix(name, "/") || IsTempPart(attrs.Name) ||
+			(attrs.Bucket == a.dstObject.BucketName() && attrs.Name == a.dstObject.ObjectName()) {
+			continue
+		}
+
+		if attrs.Updated.Before(a.options.ModifiedAfter) {
+			log.Printf("%s - '%s' skipping object last modified %s before %s", workerName, attrs.Name, attrs.Updated.Format(time.RFC3339), a.options.ModifiedAfter.Format(time.RFC3339))
+			skipped++
+			continue
+		}
+
+		if err := a.addObject(ctx, tarWriter, name, attrs); err != nil {
+			return abort(err)
+		}
+		objects++
+		bytesIn += attrs.Size
+	}
+
+	if err := tarWriter.Close(); err != nil {
+		return abort(fmt.Errorf("failed to write archive: %w", err))
+	}
+	if err := gzipWriter.Close(); err != nil {
+		return abort(fmt.Errorf("failed to compress archive: %w", err))
+	}
+	if err := dstWriter.Close(); err != nil {
+		return ArchiveResult{}, fmt.Errorf("failed to finalize destination object: %w", err)
+	}
+
+	bytesOut := dstWriter.Attrs().Size
+	var compressionRatio float64
+	if bytesOut > 0 {
+		compressionRatio = float64(bytesIn) / float64(bytesOut)
+	}
+	elapsed := time.Since(start)
+	log.Printf("%s - archived %d objects with %d bytes to %d bytes in %s/%s. Compression ratio %.2f. Took %s", workerName, objects, bytesIn, bytesOut, a.dstObject.BucketName(), a.dstObject.ObjectName(), compressionRatio, elapsed.Round(time.Millisecond))
+
+	return ArchiveResult{
+		Result: Result{
+			BytesIn:  bytesIn,
+			BytesOut: bytesOut,
+			Ratio:    compressionRatio,
+			Codec:    "tar+gzip",
+			Duration: elapsed,
+		},
+		Objects: objects,
+		Skipped: skipped,
+	}, nil
+}
+
+// addObject streams a single source object into the tar archive. Objects with a
+// Content-Encoding are archived as stored, as only the stored size is known for the header
+func (a *Archiver) addObject(ctx context.Context, tarWriter *tar.Writer, name string, attrs *storage.ObjectAttrs) error {
+	// read the listed generation to ensure the size matches the tar header
+	srcReader, err := a.srcBucket.Object(attrs.Name).Generation(attrs.Generation).ReadCompressed(true).NewReader(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to open source object '%s': %w", attrs.Name, err)
+	}
+	defer srcReader.Close()
+
+	err = tarWriter.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     attrs.Size,
+		Mode:     0644,
+		ModTime:  attrs.Updated,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write archive header for '%s': %w", attrs.Name, err)
+	}
+
+	if _, err := io.Copy(tarWriter, &contextReader{ctx: ctx, r: srcReader}); err != nil {
+		return fmt.Errorf("failed to archive source object '%s': %w", attrs.Name, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,88 @@
+package core
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"testing"
+)
+
+func TestArchiveEncodedObjects(t *testing.T) {
+	f := newFakeStorage(t)
+
+	var encoded bytes.Buffer
+	gw := gzip.NewWriter(&encoded)
+	gw.Write(bytes.Repeat([]byte(`{"event":"login"}`+"\n"), 1000))
+	gw.Close()
+
+	want := map[string][]byte{
+		"plain.csv":  []byte("id,name\n1,alice\n"),
+		"event.json": encoded.Bytes(),
+	}
+	for name, data := range want {
+		attrs := fakeAttrs{}
+		if name == "event.json" {
+			attrs.ContentEncoding = "gzip"
+		}
+		f.put("src", "logs/"+name, data, attrs)
+	}
+	f.put("src", "logs/big.csv"+TempPartMarker+"0", []byte("part"), fakeAttrs{})
+
+	a, err := NewArchiver(context.Background(), gzip.DefaultCompression, "src", "logs/", "dst", "logs.tar.gz", Options{})
+	if err != nil {
+		t.Fatalf("NewArchiver: %v", err)
+	}
+	defer a.Close()
+
+	result, err := a.Archive(context.Background())
+	if err != nil {
+		t.Fatalf("Archive: %v", err)
+	}
+	if result.Objects != len(want) {
+		t.Errorf("archived %d objects, want %d", result.Objects, len(want))
+	}
+
+	archive, _ := f.object("dst", "logs.tar.gz")
+	tr := tar.NewReader(bytes.NewReader(gunzip(t, archive.data)))
+	got := make(map[string][]byte)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("reading archive: %v", err)
+		}
+		got[hdr.Name], _ = io.ReadAll(tr)
+	}
+	if len(got) != len(want) {
+		t.Errorf("archive holds %d entries, want %d", len(got), len(want))
+	}
+	for name, data := range want {
+		if !bytes.Equal(got[name], data) {
+			t.Errorf("entry '%s' differs from the stored object", name)
+		}
+	}
+}
+
+func TestArchiveInvalidLevel(t *testing.T) {
+	f := newFakeStorage(t)
+	f.put("src", "logs/app.log", []byte("2024-01-01 INFO request served\n"), fakeAttrs{})
+
+	for _, level := range []int{10, -3} {
+		a, err := NewArchiver(context.Background(), level, "src", "logs/", "dst", "logs.tar.gz", Options{})
+		if err != nil {
+			t.Fatalf("NewArchiver: %v", err)
+		}
+		defer a.Close()
+
+		if _, err := a.Archive(context.Background()); err == nil {
+			t.Errorf("level %d: Archive succeeded, want an error", level)
+		}
+		if names := f.names("dst"); len(names) > 0 {
+			t.Errorf("level %d: destination holds %v", level, names)
+		}
+	}
+}
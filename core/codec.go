@@ -0,0 +1,137 @@
+package core
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/golang/snappy"
+)
+
+// CodecMetadataKey is the custom metadata key of destination objects written without
+// content encoding, e.g. with a codec that has none. It holds the name of the codec
+const CodecMetadataKey = "compression-codec"
+
+// Codec describes a compression format supported by the workflow
+type Codec struct {
+	Name string
+	// ContentEncoding is set on destination objects written with the codec. Codecs without
+	// standard content encoding are marked via CodecMetadataKey instead
+	ContentEncoding string
+	// Extension is the usual extension of objects written with the codec
+	Extension string
+	// MinLevel, MaxLevel and DefaultLevel describe the native compression levels
+	MinLevel     int
+	MaxLevel     int
+	DefaultLevel int
+	// MapLevel translates a level of the GZIP scheme (-1 default, 1 fastest to 9 best) to
+	// a native level and reports whether the level is supported. Nil for codecs using the
+	// GZIP scheme natively
+	MapLevel func(level int) (int, bool)
+	// Concatenable codecs form a valid stream when streams are concatenated, which parallel
+	// compression and appending rely on
+	Concatenable bool
+	NewWriter    func(w io.Writer, level int) (io.WriteCloser, error)
+	NewReader    func(r io.Reader) (io.ReadCloser, error)
+}
+
+var codecs = []Codec{
+	{
+		Name:            "gzip",
+		ContentEncoding: "gzip",
+		Extension:       ".gz",
+		MinLevel:        gzip.HuffmanOnly,
+		MaxLevel:        gzip.BestCompression,
+		DefaultLevel:    gzip.DefaultCompression,
+		Concatenable:    true,
+		NewWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			gzipWriter, err := gzip.NewWriterLevel(w, level)
+			if err != nil {
+				return nil, err
+			}
+			// the header carries no modification time, name or OS, so identical inputs
+			// are compressed to identical bytes
+			gzipWriter.Header = gzip.Header{OS: 255}
+			return gzipWriter, nil
+		},
+		NewReader: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	},
+	{
+		// snappy framing format, whose streams can be concatenated like GZIP members.
+		// Snappy has no compression levels
+		Name:         "snappy",
+		Extension:    ".snappy",
+		MinLevel:     gzip.DefaultCompression,
+		MaxLevel:     gzip.DefaultCompression,
+		DefaultLevel: gzip.DefaultCompression,
+		Concatenable: true,
+		// all levels map to the single one of snappy
+		MapLevel: func(level int) (int, bool) {
+			return gzip.DefaultCompression, level == gzip.DefaultCompression || (level >= gzip.BestSpeed && level <= gzip.BestCompression)
+		},
+		NewWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			return snappy.NewBufferedWriter(w), nil
+		},
+		NewReader: func(r io.Reader) (io.ReadCloser, error) {
+			return io.NopCloser(snappy.NewReader(r)), nil
+		},
+	},
+	{
+		// raw DEFLATE without GZIP header and trailer for consumers doing their own framing.
+		// Content-Encoding deflate means zlib framing, so it is marked via metadata
+		Name:         "deflate",
+		Extension:    ".deflate",
+		MinLevel:     flate.HuffmanOnly,
+		MaxLevel:     flate.BestCompression,
+		DefaultLevel: flate.DefaultCompression,
+		NewWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			return flate.NewWriter(w, level)
+		},
+		NewReader: func(r io.Reader) (io.ReadCloser, error) {
+			return flate.NewReader(r), nil
+		},
+	},
+}
+
+// DefaultCodec is the codec used unless Options.Codec is set
+var DefaultCodec = codecs[0]
+
+// Codecs returns all codecs supported by this build
+func Codecs() []Codec {
+	return codecs
+}
+
+// LookupCodec returns the codec with the given name
+func LookupCodec(name string) (Codec, bool) {
+	for _, codec := range codecs {
+		if codec.Name == name {
+			return codec, true
+		}
+	}
+	return Codec{}, false
+}
+
+// ValidLevel reports whether the native compression level is supported by the codec
+func (c Codec) ValidLevel(level int) bool {
+	return level >= c.MinLevel && level <= c.MaxLevel
+}
+
+// Level translates a compression level of the GZIP scheme, e.g. of -compressionLevel, to
+// the native level of the codec and reports whether the codec supports it
+func (c Codec) Level(level int) (int, bool) {
+	if c.MapLevel != nil {
+		return c.MapLevel(level)
+	}
+	return level, c.ValidLevel(level)
+}
+
+// Levels describes the levels of the GZIP scheme accepted by the codec
+func (c Codec) Levels() string {
+	if c.MapLevel != nil {
+		return fmt.Sprintf("-1 and 1 to 9, mapped to native levels from %d to %d", c.MinLevel, c.MaxLevel)
+	}
+	return fmt.Sprintf("%d to %d", c.MinLevel, c.MaxLevel)
+}
@@ -0,0 +1,94 @@
+package core
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"io"
+	"testing"
+)
+
+// testData is compressible input with some variation
+func testData() []byte {
+	var b bytes.Buffer
+	for i := 0; i < 20000; i++ {
+		b.WriteString("2024-01-01T00:00:00Z INFO request ")
+		b.WriteByte(byte('a' + i%26))
+		b.WriteString(" served\n")
+	}
+	return b.Bytes()
+}
+
+// compress compresses data with CompressStream or fails the test
+func compress(t testing.TB, codec Codec, level int, data []byte) []byte {
+	t.Helper()
+	var out bytes.Buffer
+	n, err := CompressStream(context.Background(), &out, bytes.NewReader(data), codec, level, 0)
+	if err != nil {
+		t.Fatalf("CompressStream with %s: %v", codec.Name, err)
+	}
+	if n != int64(len(data)) {
+		t.Fatalf("CompressStream read %d bytes, want %d", n, len(data))
+	}
+	return out.Bytes()
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	data := testData()
+	for _, name := range []string{"gzip", "snappy", "deflate"} {
+		t.Run(name, func(t *testing.T) {
+			codec, ok := LookupCodec(name)
+			if !ok {
+				t.Fatalf("codec %s is not registered", name)
+			}
+			compressed := compress(t, codec, codec.DefaultLevel, data)
+			if len(compressed) >= len(data) {
+				t.Errorf("compressed %d bytes to %d bytes", len(data), len(compressed))
+			}
+
+			r, err := codec.NewReader(bytes.NewReader(compressed))
+			if err != nil {
+				t.Fatalf("NewReader: %v", err)
+			}
+			defer r.Close()
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("reading %s stream: %v", name, err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Error("decompressed data differs from the input")
+			}
+		})
+	}
+}
+
+func TestDeflateIsRawDeflate(t *testing.T) {
+	data := testData()
+	codec, _ := LookupCodec("deflate")
+	compressed := compress(t, codec, codec.DefaultLevel, data)
+	if bytes.HasPrefix(compressed, []byte{0x1f, 0x8b}) {
+		t.Fatal("deflate stream has a GZIP header")
+	}
+
+	// consumers read it with a plain DEFLATE reader
+	r := flate.NewReader(bytes.NewReader(compressed))
+	defer r.Close()
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("reading deflate stream: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("decompressed data differs from the input")
+	}
+}
+
+func TestGzipIsDeterministic(t *testing.T) {
+	data := testData()
+	for _, level := range []int{1, DefaultCodec.DefaultLevel, 9} {
+		first := compress(t, DefaultCodec, level, data)
+		second := compress(t, DefaultCodec, level, data)
+		if !bytes.Equal(first, second) {
+			t.Errorf("level %d: compressing the same input twice gave different bytes", level)
+		}
+	}
+}
@@ -1,14 +1,26 @@
 package core
 
 import (
+	"bufio"
 	"compress/gzip"
 	"context"
+	"encoding/base64"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode"
 
 	"cloud.google.com/go/storage"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/api/option"
 )
 
 type WorkflowContextKey int
@@ -18,38 +30,329 @@ type WorkflowContext struct {
 	ObjectName                string
 	OriginalMessageAttributes map[string]string
 	OriginalMessageData       []byte
+	// Ack and Nack settle the original message once the object has been processed.
+	// They are nil if the message was acknowledged on receipt
+	Ack  func()
+	Nack func()
 }
 
 var ContextData WorkflowContextKey
 
+// CompressionLevelMetadataKey is the custom metadata key of a source object used to
+// override the compression level of the workflow for that object
+const CompressionLevelMetadataKey = "compression-level"
+
+// ErrObjectTooSmall is returned by Compress when the source object is smaller
+// than Options.MinSize and is not copied to the destination
+var ErrObjectTooSmall = errors.New("source object is smaller than the minimum size")
+
+// custom metadata keys of the destination object describing the uncompressed source
+const (
+	UncompressedSizeMetadataKey   = "uncompressed-size"
+	UncompressedCRC32CMetadataKey = "uncompressed-crc32c"
+	SourceCRC32CMetadataKey       = "src-crc32c"
+	SourceMD5MetadataKey          = "src-md5"
+)
+
+// ProducerMetadataKey is the custom metadata key of the destination object naming the
+// host and worker that wrote it, set with Options.TagProducer
+const ProducerMetadataKey = "compressed-by"
+
+// ErrTooLarge is returned by Compress when the source object is larger than Options.MaxSize
+var ErrTooLarge = errors.New("source object is larger than the maximum size")
+
+// ErrContentTypeSkipped is returned by Compress when the content type of the source object
+// is not in Options.CompressContentTypes or is in Options.SkipContentTypes
+var ErrContentTypeSkipped = errors.New("source object content type is not compressed")
+
+// ErrObjectEmpty is returned by Compress when the source object has no content
+// and Options.SkipEmpty is set
+var ErrObjectEmpty = errors.New("source object is empty")
+
+// ErrSourceGone is returned by Compress when the source object does not exist (anymore),
+// e.g. because it was deleted between the notification and processing it
+var ErrSourceGone = errors.New("source object does not exist")
+
+// ErrDestinationExists is returned by Compress when the destination object exists
+// already and Options.OnExisting is OnExistingError
+var ErrDestinationExists = errors.New("destination object exists already")
+
+// ErrDestinationSkipped is returned by Compress when the destination object exists
+// already and Options.OnExisting is OnExistingSkip
+var ErrDestinationSkipped = errors.New("destination object exists already, skipped")
+
+// ErrLowRatio is returned by Compress when the compression ratio is below Options.MinRatio.
+// The destination object is deleted again and the source kept
+var ErrLowRatio = errors.New("compression ratio is below the minimum ratio")
+
+// ErrInPlaceSkipped is returned by Compress with Options.InPlace when there is nothing to
+// replace, e.g. because the source object is encoded already or compression would not shrink it
+var ErrInPlaceSkipped = errors.New("source object is kept as is in place")
+
+// ErrSourceChanged is returned by Compress with Options.InPlace when the source object was
+// overwritten while it was compressed. The newer generation is kept
+var ErrSourceChanged = errors.New("source object changed while compressing in place")
+
+// ExistingPolicy decides how an existing destination object is handled
+type ExistingPolicy string
+
+const (
+	// OnExistingError fails with ErrDestinationExists. It is the default
+	OnExistingError ExistingPolicy = "error"
+	// OnExistingSkip skips the object with ErrDestinationSkipped, e.g. for redelivered events
+	OnExistingSkip ExistingPolicy = "skip"
+	// OnExistingOverwrite replaces the destination object
+	OnExistingOverwrite ExistingPolicy = "overwrite"
+)
+
+// ExistingPolicies are all values of ExistingPolicy
+var ExistingPolicies = []ExistingPolicy{OnExistingError, OnExistingSkip, OnExistingOverwrite}
+
+// existingError returns the error for an existing destination object
+func existingError(policy ExistingPolicy) error {
+	if policy == OnExistingSkip {
+		return ErrDestinationSkipped
+	}
+	return ErrDestinationExists
+}
+
+// ErrSourceRetained is returned by Delete when the source object cannot be deleted
+// because of an object hold or a retention policy
+var ErrSourceRetained = errors.New("source object is retained")
+
+// MetadataRoute routes source objects whose custom metadata Key has Value to the
+// destination bucket Bucket
+type MetadataRoute struct {
+	Key    string
+	Value  string
+	Bucket string
+}
+
+// Options are optional settings of a Workflow. The zero value keeps the default behavior
+type Options struct {
+	// MinSize is the minimum size in bytes of a source object to be compressed
+	MinSize int64
+	// NotFoundRetries retries opening a missing source object, which may briefly not be
+	// visible right after its upload, waiting NotFoundDelay in between. 0 fails immediately
+	NotFoundRetries int
+	NotFoundDelay   time.Duration
+	// SourceGeneration selects a specific generation of the source object, which is then
+	// also the generation deleted by Delete. 0 uses the live version
+	SourceGeneration int64
+	// MaxSize is the maximum size in bytes of a source object to be compressed. 0 is unlimited
+	MaxSize int64
+	// SkipEmpty skips empty source objects instead of copying them to the destination
+	SkipEmpty bool
+	// CopySmallFiles copies objects smaller than MinSize verbatim to the destination
+	CopySmallFiles bool
+	// CopyExtensions are extensions of already compressed objects (e.g. .gz, .zip, .jpg) that
+	// are copied verbatim to the destination instead of being compressed
+	CopyExtensions []string
+	// PartitionByDate prepends a Hive-style partition of the creation date of the source
+	// object (year=YYYY/month=MM/day=DD/) to the destination object name
+	PartitionByDate bool
+	// CompressContentTypes limits compression to source objects of these content types, e.g.
+	// text/* or application/json. SkipContentTypes skips objects of these content types, e.g.
+	// image/*. Skipped objects return ErrContentTypeSkipped
+	CompressContentTypes []string
+	SkipContentTypes     []string
+	// LevelBySize selects the compression level by the size of the source object, e.g.
+	// BestSpeed for small and BestCompression for large objects. Levels are native levels of
+	// the codec. Objects larger than all thresholds use the level of the workflow
+	LevelBySize []SizeLevel
+	// MetadataRoutes route source objects to other destination buckets based on their custom
+	// metadata. The first matching route applies, without a match the destination is kept
+	MetadataRoutes []MetadataRoute
+	// Codec compresses the destination object. The zero value uses DefaultCodec (gzip)
+	Codec Codec
+	// OmitContentEncoding stores compressed objects without Content-Encoding, so GCS serves
+	// the compressed bytes as is instead of transcoding them
+	OmitContentEncoding bool
+	// ContentType overrides the content type of the source object on the destination
+	ContentType string
+	// KMSKeyName is the Cloud KMS key used to encrypt the destination object. When empty
+	// the default encryption of the destination bucket applies
+	KMSKeyName string
+	// PredefinedACL is applied to the destination object, e.g. publicRead. When empty
+	// the default object ACL of the destination bucket applies
+	PredefinedACL string
+	// ModifiedAfter skips listed objects last updated before the given time. Zero disables the filter
+	ModifiedAfter time.Time
+	// PreserveCustomTime sets the custom time of destination objects to the custom time or
+	// else the creation time of the source, so age-based lifecycle rules on custom time treat
+	// the destination as old as the source
+	PreserveCustomTime bool
+	// StorageClass is the storage class of destination objects, e.g. NEARLINE. Empty uses
+	// the default storage class of the destination bucket
+	StorageClass string
+	// TemporaryHold and EventBasedHold place the respective hold on destination objects,
+	// e.g. as required by a retention policy of the destination bucket. Holds are placed once
+	// all destinations are written, so a failed workflow can still delete what it wrote
+	TemporaryHold  bool
+	EventBasedHold bool
+	// CompressEncoded compresses source objects uploaded with a Content-Encoding, e.g.
+	// pre-compressed with gzip. By default they are copied as is, keeping their encoding
+	CompressEncoded bool
+	// ReplicaBuckets receive a copy of each destination object under the same name, e.g.
+	// regional buckets for disaster recovery. If writing any of them fails, all are removed
+	ReplicaBuckets []string
+	// OnExisting handles existing destination objects. The zero value is OnExistingError
+	OnExisting ExistingPolicy
+	// MinRatio is the minimum compression ratio, e.g. 1.05, worth keeping the compressed
+	// object. Below it the destination is deleted and Compress returns ErrLowRatio. 0 keeps all
+	MinRatio float64
+	// SkipRatio skips reading the destination object metadata after writing it. Result.BytesOut
+	// and Result.Ratio are then 0, saving a round trip per object
+	SkipRatio bool
+	// StoreOriginalSize stores size and CRC32C of the source object in the metadata of the destination
+	StoreOriginalSize bool
+	// StoreSourceChecksums stores CRC32C and MD5 of the source object in the metadata of the
+	// destination, which VerifyDecompressed checks
+	StoreSourceChecksums bool
+	// DeleteOnInflation deletes the source object even if its compressed destination is not
+	// smaller. By default Delete keeps such a source. Without the compression ratio, see
+	// SkipRatio, the source is always deleted
+	DeleteOnInflation bool
+	// TagProducer stores host name and worker name as 'compressed-by' metadata on the
+	// destination to tell which instance wrote it
+	TagProducer bool
+	// ChunkSize is the size in bytes of the chunks of resumable uploads to the destination.
+	// Each upload buffers a chunk in memory. 0 keeps the client default of 16 MiB
+	ChunkSize int
+	// ParallelChunks splits the source object into byte ranges that are compressed concurrently
+	// and composed into the destination object. 0 and 1 compress a single stream
+	ParallelChunks int
+	// Append compresses the source and composes it onto the end of an existing destination
+	// object instead of replacing it, creating the destination if absent. Concatenated GZIP
+	// members form a valid stream. OnExisting does not apply
+	Append bool
+	// InPlace replaces the source object by its compressed version under the same name. The
+	// destination needs to be the source object. Delete keeps the result
+	InPlace bool
+	// DownloadParallelism downloads the source object in byte ranges, up to this many
+	// concurrently, that feed the single compression stream in order. 0 and 1 read a
+	// single stream
+	DownloadParallelism int
+	// GzipHeaderName and GzipHeaderComment are written to the Name and Comment fields of
+	// GZIP headers, e.g. for traceability. The name is a template as of ExpandTemplate
+	GzipHeaderName    string
+	GzipHeaderComment string
+	// Deterministic writes GZIP headers without modification time, name and OS, even if
+	// GzipHeaderName is set, so identical inputs yield byte-identical output
+	Deterministic bool
+	// GzipBufferSize is the size in bytes of a buffer between the GZIP writer and the
+	// destination writer. 0 disables buffering
+	GzipBufferSize int
+	// BytesRead, if set, is advanced by the bytes of the source object read while compressing
+	// as a single stream, e.g. to report the progress of in-flight objects
+	BytesRead *atomic.Int64
+	// UserProject is the project billed for requests, required to access requester-pays
+	// buckets. Empty bills the bucket's project
+	UserProject string
+	// SourceClientOptions and DestinationClientOptions configure separate storage clients
+	// for source and destination, e.g. for buckets in different projects. When both are
+	// empty a single client is shared
+	SourceClientOptions      []option.ClientOption
+	DestinationClientOptions []option.ClientOption
+}
+
+// Result describes the outcome of a successful Compress
+type Result struct {
+	BytesIn  int64
+	BytesOut int64
+	Ratio    float64
+	Codec    string
+	// CopyReason is set when the object was copied instead of compressed
+	CopyReason string
+	Duration   time.Duration
+}
+
+// reasons of Result.CopyReason
+const (
+	CopyReasonEmpty     = "empty"
+	CopyReasonTooSmall  = "too_small"
+	CopyReasonExtension = "extension"
+	CopyReasonEncoded   = "content_encoding"
+)
+
 type Workflow struct {
 	client           *storage.Client
+	dstClient        *storage.Client
 	srcObject        *storage.ObjectHandle
 	dstObject        *storage.ObjectHandle
+	dstObjectName    string
 	compressionLevel int
+	options          Options
+	// inflated is set by Compress when the destination is not smaller than the source
+	inflated bool
 }
 
-func NewWorkflow(ctx context.Context, compressionLevel int, sourceBucketName, sourceObjectName, destinationBucketName, destinationObjectName string) (*Workflow, error) {
+func NewWorkflow(ctx context.Context, compressionLevel int, sourceBucketName, sourceObjectName, destinationBucketName, destinationObjectName string, options Options) (wf *Workflow, err error) {
+	ctx, span := tracer.Start(ctx, "NewWorkflow", trace.WithAttributes(
+		attribute.String("gcs.source.bucket", sourceBucketName),
+		attribute.String("gcs.source.object", sourceObjectName),
+		attribute.String("gcs.destination.bucket", destinationBucketName),
+		attribute.String("gcs.destination.object", destinationObjectName),
+	))
+	defer func() { endSpan(span, err) }()
+
 	c := &Workflow{}
 
 	c.compressionLevel = compressionLevel
+	c.options = options
 
-	var err error
-	if c.client, err = storage.NewClient(ctx); err != nil {
-		return nil, fmt.Errorf("failed to create GCS client: %v", err)
+	if c.client, c.dstClient, err = newClients(ctx, options); err != nil {
+		return nil, err
 	}
 
-	srcBucket := c.client.Bucket(sourceBucketName)
+	srcBucket := c.client.Bucket(sourceBucketName).UserProject(options.UserProject)
 	c.srcObject = srcBucket.Object(sourceObjectName)
+	if options.SourceGeneration > 0 {
+		c.srcObject = c.srcObject.Generation(options.SourceGeneration)
+	}
 
-	dstBucket := c.client.Bucket(destinationBucketName)
+	dstBucket := c.dstBucket(destinationBucketName)
 	c.dstObject = dstBucket.Object(destinationObjectName)
+	c.dstObjectName = destinationObjectName
 
 	return c, nil
 }
 
 func (c *Workflow) Close() {
-	c.client.Close()
+	closeClients(c.client, c.dstClient)
+}
+
+// dstBucket returns a destination bucket handle billing Options.UserProject
+func (c *Workflow) dstBucket(name string) *storage.BucketHandle {
+	return c.dstClient.Bucket(name).UserProject(c.options.UserProject)
+}
+
+// newClients creates the storage clients for source and destination. Both are the
+// same client unless separate client options are provided
+func newClients(ctx context.Context, options Options) (*storage.Client, *storage.Client, error) {
+	srcClient, err := storage.NewClient(ctx, options.SourceClientOptions...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create GCS client: %v", err)
+	}
+
+	if len(options.SourceClientOptions) == 0 && len(options.DestinationClientOptions) == 0 {
+		return srcClient, srcClient, nil
+	}
+
+	dstClient, err := storage.NewClient(ctx, options.DestinationClientOptions...)
+	if err != nil {
+		srcClient.Close()
+		return nil, nil, fmt.Errorf("failed to create destination GCS client: %v", err)
+	}
+
+	return srcClient, dstClient, nil
+}
+
+func closeClients(srcClient, dstClient *storage.Client) {
+	srcClient.Close()
+	if dstClient != srcClient {
+		dstClient.Close()
+	}
 }
 
 func GetContextData(ctx context.Context) (WorkflowContext, error) {
@@ -72,78 +375,634 @@ func GetWorkerName(ctx context.Context) string {
 }
 
 // Compress reads a source file in GCS and writes it GZIP compressed to GCS
-func (c *Workflow) Compress(ctx context.Context) error {
+func (c *Workflow) Compress(ctx context.Context) (Result, error) {
+	ctx, span := tracer.Start(ctx, "Compress", trace.WithAttributes(objectAttributes(c.srcObject, c.dstObject)...))
+	result, err := c.compress(ctx)
+	span.SetAttributes(resultAttributes(result)...)
+	endSpan(span, err)
+
+	return result, err
+}
+
+func (c *Workflow) compress(ctx context.Context) (Result, error) {
 	workerName := GetWorkerName(ctx)
+	start := time.Now()
 
 	// Open the source object for reading
-	srcReader, err := c.srcObject.NewReader(ctx)
+	srcReader, srcObjectAttrs, err := c.openSource(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to open source object: %w", err)
+		return Result{}, err
 	}
 	defer srcReader.Close()
 
-	srcObjectAttrs, err := c.srcObject.Attrs(ctx)
-	if err != nil {
-		return fmt.Errorf("cannot determine source object size: %w", err)
+	for _, route := range c.options.MetadataRoutes {
+		if value, ok := srcObjectAttrs.Metadata[route.Key]; ok && value == route.Value {
+			log.Printf("%s - '%s' routing to bucket '%s' by metadata %s=%s", workerName, c.srcObject.ObjectName(), route.Bucket, route.Key, route.Value)
+			c.dstObject = c.dstBucket(route.Bucket).Object(c.dstObject.ObjectName())
+			break
+		}
+	}
+
+	// {date} of a destination template is the creation date of the source object
+	if strings.Contains(c.dstObjectName, "{date}") {
+		c.dstObjectName = strings.ReplaceAll(c.dstObjectName, "{date}", srcObjectAttrs.Created.UTC().Format(time.DateOnly))
+		c.dstObject = c.dstBucket(c.dstObject.BucketName()).Object(c.dstObjectName)
+	}
+
+	if c.options.PartitionByDate {
+		c.dstObject = c.dstBucket(c.dstObject.BucketName()).Object(DatePartition(srcObjectAttrs.Created) + c.dstObjectName)
 	}
 
-	if c.dstObjectExists(ctx) {
-		return fmt.Errorf("destination object exists already")
+	if c.options.MaxSize > 0 && srcObjectAttrs.Size > c.options.MaxSize {
+		return Result{}, fmt.Errorf("%w: %d bytes exceed %d bytes", ErrTooLarge, srcObjectAttrs.Size, c.options.MaxSize)
 	}
 
-	bytesProcessed, err := (func() (int64, error) {
-		dstWriter := c.dstObject.NewWriter(ctx)
-		defer dstWriter.Close()
+	// GZIP would turn an empty object into a non-empty one, so an empty object is
+	// copied as is, which is still correctly encoded
+	empty := srcObjectAttrs.Size == 0
+	if empty && c.options.SkipEmpty {
+		log.Printf("%s - '%s' skipping empty object", workerName, c.srcObject.ObjectName())
+		return Result{}, ErrObjectEmpty
+	}
+
+	tooSmall := !empty && srcObjectAttrs.Size < c.options.MinSize
+	if tooSmall && !c.options.CopySmallFiles {
+		log.Printf("%s - '%s' skipping object of size %d smaller than minimum size %d", workerName, c.srcObject.ObjectName(), srcObjectAttrs.Size, c.options.MinSize)
+		return Result{}, ErrObjectTooSmall
+	}
+
+	if (len(c.options.CompressContentTypes) > 0 && !MatchContentType(srcObjectAttrs.ContentType, c.options.CompressContentTypes)) || MatchContentType(srcObjectAttrs.ContentType, c.options.SkipContentTypes) {
+		log.Printf("%s - '%s' skipping object of content type '%s'", workerName, c.srcObject.ObjectName(), srcObjectAttrs.ContentType)
+		return Result{}, fmt.Errorf("%w: '%s'", ErrContentTypeSkipped, srcObjectAttrs.ContentType)
+	}
 
-		// Set appropriate content type and encoding for the destination object
-		dstWriter.ContentType = srcObjectAttrs.ContentType
-		dstWriter.ContentEncoding = "gzip"
+	// appended objects are always compressed, a verbatim copy would break the stream
+	if c.options.Append {
+		return c.compressAppend(ctx, srcObjectAttrs, srcReader, start)
+	}
 
-		// Create a GZIP writer wrapping the GCS writer
-		gzipWriter, _ := gzip.NewWriterLevel(dstWriter, c.compressionLevel)
-		defer gzipWriter.Close()
+	// the destination is the source itself, so it always exists
+	if c.options.InPlace {
+		return c.compressInPlace(ctx, srcObjectAttrs, srcReader, start)
+	}
 
-		// Stream from the source object to the GZIP writer (and then to GCS)
-		log.Printf("%s - '%s' reading file from bucket '%s' and to writing compressed to '%s/%s'", workerName, c.srcObject.ObjectName(), c.srcObject.BucketName(), c.dstObject.BucketName(), c.dstObject.ObjectName())
-		n, err := io.Copy(gzipWriter, srcReader)
-		if err != nil {
-			return -1, fmt.Errorf("failed to compress and upload object: %w", err)
+	if c.options.OnExisting != OnExistingOverwrite && c.dstObjectExists(ctx) {
+		log.Printf("%s - '%s' destination object '%s/%s' exists already", workerName, c.srcObject.ObjectName(), c.dstObject.BucketName(), c.dstObject.ObjectName())
+		return Result{}, existingError(c.options.OnExisting)
+	}
+
+	var copyReason string
+	switch {
+	case empty:
+		log.Printf("%s - '%s' source object is empty, writing empty destination object", workerName, c.srcObject.ObjectName())
+		copyReason = CopyReasonEmpty
+	case tooSmall:
+		copyReason = CopyReasonTooSmall
+	case len(c.options.CopyExtensions) > 0 && HasExtension(c.srcObject.ObjectName(), c.options.CopyExtensions):
+		copyReason = CopyReasonExtension
+	case !c.options.CompressEncoded && srcObjectAttrs.ContentEncoding != "" && srcObjectAttrs.ContentEncoding != "identity":
+		// uploaded pre-compressed, the copy keeps the content encoding
+		log.Printf("%s - '%s' source object has Content-Encoding '%s', passing it through", workerName, c.srcObject.ObjectName(), srcObjectAttrs.ContentEncoding)
+		copyReason = CopyReasonEncoded
+	}
+	if copyReason != "" {
+		if err := c.copy(ctx, srcObjectAttrs); err != nil {
+			return Result{}, err
+		}
+		if err := c.replicate(ctx); err != nil {
+			return Result{}, err
+		}
+		if err := c.holdDestinations(ctx); err != nil {
+			return Result{}, err
 		}
+		return Result{
+			BytesIn:    srcObjectAttrs.Size,
+			BytesOut:   srcObjectAttrs.Size,
+			Ratio:      1,
+			Codec:      "none",
+			CopyReason: copyReason,
+			Duration:   time.Since(start),
+		}, nil
+	}
 
-		return n, nil
-	})()
+	level := c.objectCompressionLevel(ctx, srcObjectAttrs)
+	var bytesProcessed int64
+	// byte ranges of an encoded source are ranges of the stored encoding, so it is streamed
+	if c.options.ParallelChunks > 1 && srcObjectAttrs.ContentEncoding == "" {
+		bytesProcessed, err = c.compressParallel(ctx, srcObjectAttrs, level)
+		if err == nil {
+			err = c.replicate(ctx)
+		}
+	} else {
+		reader := c.sourceReader(ctx, srcObjectAttrs, srcReader)
+		bytesProcessed, err = c.compressStream(ctx, srcObjectAttrs, reader, level)
+		reader.Close()
+	}
 	if err != nil {
-		return err
+		return Result{}, err
+	}
+
+	log.Printf("%s - '%s' read %d bytes from file of size %d", workerName, c.srcObject.ObjectName(), bytesProcessed, srcObjectAttrs.Size)
+	elapsed := time.Since(start)
+	var throughput float64
+	if elapsed > 0 {
+		throughput = float64(bytesProcessed) / (1024 * 1024) / elapsed.Seconds()
+	}
+
+	if c.options.SkipRatio {
+		log.Printf("%s - '%s' compressed %d bytes to %s/%s with %s level %d. Took %s (%.2f MB/s)", workerName, c.srcObject.ObjectName(), bytesProcessed, c.dstObject.BucketName(), c.dstObject.ObjectName(), c.codec().Name, level, elapsed.Round(time.Millisecond), throughput)
+		if err := c.holdDestinations(ctx); err != nil {
+			return Result{}, err
+		}
+		return Result{
+			BytesIn:  bytesProcessed,
+			Codec:    c.codec().Name,
+			Duration: elapsed,
+		}, nil
 	}
 
 	dstObjectAttrs, err := c.dstObject.Attrs(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to read destination object metadata: %w", err)
+		return Result{}, accessError(fmt.Errorf("failed to read destination object metadata: %w", err), opReadDestination, c.dstObject.BucketName())
 	}
 
 	var compressionRatio float64
 	if dstObjectAttrs.Size > 0 {
 		compressionRatio = float64(srcObjectAttrs.Size) / float64(dstObjectAttrs.Size)
 	}
-	log.Printf("%s - '%s' read %d bytes from file of size %d", workerName, c.srcObject.ObjectName(), bytesProcessed, srcObjectAttrs.Size)
-	log.Printf("%s - '%s' compressed %d bytes to %d bytes in %s/%s. Compression ratio %.2f", workerName, c.srcObject.ObjectName(), bytesProcessed, dstObjectAttrs.Size, c.dstObject.BucketName(), c.dstObject.ObjectName(), compressionRatio)
+	log.Printf("%s - '%s' compressed %d bytes to %d bytes in %s/%s with %s level %d. Compression ratio %.2f. Took %s (%.2f MB/s)", workerName, c.srcObject.ObjectName(), bytesProcessed, dstObjectAttrs.Size, c.dstObject.BucketName(), c.dstObject.ObjectName(), c.codec().Name, level, compressionRatio, elapsed.Round(time.Millisecond), throughput)
+
+	if c.options.MinRatio > 0 && compressionRatio < c.options.MinRatio {
+		log.Printf("%s - '%s' compression ratio %.2f is below minimum ratio %.2f, deleting the destination and keeping the source uncompressed", workerName, c.srcObject.ObjectName(), compressionRatio, c.options.MinRatio)
+		c.deleteWritten(ctx, c.destinationObjects())
+		return Result{}, fmt.Errorf("%w: %.2f < %.2f", ErrLowRatio, compressionRatio, c.options.MinRatio)
+	}
+	c.inflated = dstObjectAttrs.Size >= srcObjectAttrs.Size
+
+	if err := c.holdDestinations(ctx); err != nil {
+		return Result{}, err
+	}
+
+	return Result{
+		BytesIn:  bytesProcessed,
+		BytesOut: dstObjectAttrs.Size,
+		Ratio:    compressionRatio,
+		Codec:    c.codec().Name,
+		Duration: elapsed,
+	}, nil
+}
+
+// openSource opens the source object and reads its attributes. A missing object is retried
+// Options.NotFoundRetries times, as it may briefly not be visible right after its upload
+func (c *Workflow) openSource(ctx context.Context) (*storage.Reader, *storage.ObjectAttrs, error) {
+	for attempt := 0; ; attempt++ {
+		srcReader, srcObjectAttrs, err := c.openSourceOnce(ctx)
+		if !errors.Is(err, ErrSourceGone) || attempt >= c.options.NotFoundRetries {
+			return srcReader, srcObjectAttrs, err
+		}
+
+		log.Printf("%s - '%s' source object not found, retrying in %s (%d/%d)", GetWorkerName(ctx), c.srcObject.ObjectName(), c.options.NotFoundDelay, attempt+1, c.options.NotFoundRetries)
+		select {
+		case <-time.After(c.options.NotFoundDelay):
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+	}
+}
+
+func (c *Workflow) openSourceOnce(ctx context.Context) (*storage.Reader, *storage.ObjectAttrs, error) {
+	srcReader, err := c.srcObject.NewReader(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, nil, ErrSourceGone
+	}
+	if err != nil {
+		return nil, nil, accessError(fmt.Errorf("failed to open source object: %w", err), opReadSource, c.srcObject.BucketName())
+	}
+
+	srcObjectAttrs, err := c.srcObject.Attrs(ctx)
+	if err != nil {
+		srcReader.Close()
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return nil, nil, ErrSourceGone
+		}
+		return nil, nil, accessError(fmt.Errorf("cannot determine source object size: %w", err), opReadSource, c.srcObject.BucketName())
+	}
+
+	return srcReader, srcObjectAttrs, nil
+}
+
+// sourceReader returns srcReader or, with Options.DownloadParallelism, a reader downloading
+// the source generation in concurrent byte ranges. Objects stored with a content encoding
+// are read as a single stream as they are decompressed on download
+func (c *Workflow) sourceReader(ctx context.Context, srcObjectAttrs *storage.ObjectAttrs, srcReader io.Reader) io.ReadCloser {
+	if c.options.DownloadParallelism <= 1 || srcObjectAttrs.ContentEncoding != "" || srcObjectAttrs.Size <= DownloadPartSize {
+		// srcReader is closed by its opener
+		return io.NopCloser(srcReader)
+	}
+	log.Printf("%s - '%s' downloading in ranges of %d bytes with parallelism %d", GetWorkerName(ctx), c.srcObject.ObjectName(), DownloadPartSize, c.options.DownloadParallelism)
+	return newRangeReader(ctx, c.srcObject.Generation(srcObjectAttrs.Generation), srcObjectAttrs.Size, c.options.DownloadParallelism)
+}
+
+// compressStream compresses the source object as a single GZIP stream to the destination
+// and its replicas in one read pass
+func (c *Workflow) compressStream(ctx context.Context, srcObjectAttrs *storage.ObjectAttrs, srcReader io.Reader, level int) (int64, error) {
+	workerName := GetWorkerName(ctx)
+
+	// canceling the writer context aborts the upload. This ensures that a
+	// failed compression does not finalize a truncated destination object
+	wctx, wcancel := context.WithCancel(ctx)
+	defer wcancel()
+
+	objs := c.destinationObjects()
+	dstWriters := make([]*storage.Writer, len(objs))
+	writers := make([]io.Writer, len(objs))
+	for i, obj := range objs {
+		// -append and -inPlace stream to a temporary object
+		if IsTempPart(obj.ObjectName()) {
+			dstWriters[i] = c.newTempWriter(wctx, obj, srcObjectAttrs)
+		} else {
+			dstWriters[i] = c.newDestinationWriter(wctx, obj, srcObjectAttrs)
+		}
+		writers[i] = dstWriters[i]
+	}
+	abort := func(err error) (int64, error) {
+		wcancel()
+		for _, w := range dstWriters {
+			w.Close()
+		}
+		return -1, err
+	}
+
+	if c.options.BytesRead != nil {
+		srcReader = &countingReader{r: srcReader, n: c.options.BytesRead}
+	}
+
+	// Stream from the source object to the GZIP writer (and then to GCS)
+	log.Printf("%s - '%s' reading file from bucket '%s' and to writing compressed to '%s/%s'", workerName, c.srcObject.ObjectName(), c.srcObject.BucketName(), c.dstObject.BucketName(), c.dstObject.ObjectName())
+	n, err := CompressStream(ctx, io.MultiWriter(writers...), srcReader, c.streamCodec(ctx, srcObjectAttrs), level, c.options.GzipBufferSize)
+	if err != nil {
+		return abort(accessError(fmt.Errorf("failed to compress and upload object: %w", err), opWriteDestination, c.dstObject.BucketName()))
+	}
+	for i, w := range dstWriters {
+		if err := w.Close(); err != nil {
+			wcancel()
+			for _, w := range dstWriters[i+1:] {
+				w.Close()
+			}
+			c.deleteWritten(ctx, objs[:i])
+			return -1, accessError(fmt.Errorf("failed to finalize destination object '%s/%s': %w", objs[i].BucketName(), objs[i].ObjectName(), err), opWriteDestination, objs[i].BucketName())
+		}
+	}
+
+	return n, nil
+}
+
+// CompressStream writes the content of src compressed with the codec and level to dst and
+// returns the number of bytes read. bufferSize batches the small writes of the codec writer,
+// 0 disables buffering. dst is not closed. src is streamed through a fixed size copy buffer,
+// so memory use does not depend on the size of src
+func CompressStream(ctx context.Context, dst io.Writer, src io.Reader, codec Codec, level, bufferSize int) (int64, error) {
+	var out io.Writer = dst
+	var bufferedWriter *bufio.Writer
+	if bufferSize > 0 {
+		bufferedWriter = bufio.NewWriterSize(dst, bufferSize)
+		out = bufferedWriter
+	}
+
+	codecWriter, err := codec.NewWriter(out, level)
+	if err != nil {
+		return -1, fmt.Errorf("failed to create %s writer: %w", codec.Name, err)
+	}
+
+	n, err := io.Copy(codecWriter, &contextReader{ctx: ctx, r: src})
+	if err != nil {
+		return -1, err
+	}
+
+	// flush the footer, e.g. of GZIP
+	if err := codecWriter.Close(); err != nil {
+		return -1, err
+	}
+	if bufferedWriter != nil {
+		if err := bufferedWriter.Flush(); err != nil {
+			return -1, err
+		}
+	}
+
+	return n, nil
+}
+
+// streamCodec returns the codec of the workflow writing Options.GzipHeaderName, expanded
+// for the source object, and Options.GzipHeaderComment to GZIP headers. GZIP headers are
+// Latin-1, so names that cannot be encoded are left empty. With Options.Deterministic the
+// name is left empty
+func (c *Workflow) streamCodec(ctx context.Context, srcObjectAttrs *storage.ObjectAttrs) Codec {
+	codec := c.codec()
+	if codec.Name != "gzip" || (c.options.GzipHeaderName == "" && c.options.GzipHeaderComment == "") {
+		return codec
+	}
+
+	var name string
+	if !c.options.Deterministic {
+		name = ExpandTemplate(c.options.GzipHeaderName, c.srcObject.ObjectName(), srcObjectAttrs.Created)
+	}
+	if !isLatin1(name) {
+		log.Printf("%s - '%s' warning: GZIP header name '%s' is not Latin-1, leaving it empty", GetWorkerName(ctx), c.srcObject.ObjectName(), name)
+		name = ""
+	}
+	comment := c.options.GzipHeaderComment
+
+	newWriter := codec.NewWriter
+	codec.NewWriter = func(w io.Writer, level int) (io.WriteCloser, error) {
+		codecWriter, err := newWriter(w, level)
+		if gzipWriter, ok := codecWriter.(*gzip.Writer); ok {
+			if c.options.Deterministic {
+				gzipWriter.Header = gzip.Header{OS: 255}
+			}
+			gzipWriter.Name = name
+			gzipWriter.Comment = comment
+		}
+		return codecWriter, err
+	}
+	return codec
+}
+
+// isLatin1 reports whether s can be written to a GZIP header
+func isLatin1(s string) bool {
+	for _, r := range s {
+		if r == 0 || r > unicode.MaxLatin1 {
+			return false
+		}
+	}
+	return true
+}
+
+// codec returns the codec of the workflow
+func (c *Workflow) codec() Codec {
+	if c.options.Codec.Name == "" {
+		return DefaultCodec
+	}
+	return c.options.Codec
+}
+
+// contentEncoding returns the content encoding of compressed destination objects, if any
+func (c *Workflow) contentEncoding() string {
+	if c.options.OmitContentEncoding {
+		return ""
+	}
+	return c.codec().ContentEncoding
+}
+
+// newDestinationWriter returns a writer for obj with content type, encoding, encryption,
+// metadata, ACL, storage class and custom time of the destination object set
+func (c *Workflow) newDestinationWriter(ctx context.Context, obj *storage.ObjectHandle, srcObjectAttrs *storage.ObjectAttrs) *storage.Writer {
+	w := c.newObjectWriter(ctx, obj, srcObjectAttrs)
+	w.PredefinedACL = c.options.PredefinedACL
+	w.StorageClass = c.options.StorageClass
+	w.CustomTime = c.customTime(srcObjectAttrs)
+	return w
+}
+
+// newTempWriter returns a writer for a temporary object that is composed or copied into the
+// destination and deleted right away. It is STANDARD, as other storage classes are charged
+// for a minimum storage duration
+func (c *Workflow) newTempWriter(ctx context.Context, obj *storage.ObjectHandle, srcObjectAttrs *storage.ObjectAttrs) *storage.Writer {
+	w := c.newObjectWriter(ctx, obj, srcObjectAttrs)
+	w.StorageClass = TempStorageClass
+	return w
+}
+
+// newObjectWriter returns a writer for obj with content type, encoding, encryption and
+// metadata of the destination object set
+func (c *Workflow) newObjectWriter(ctx context.Context, obj *storage.ObjectHandle, srcObjectAttrs *storage.ObjectAttrs) *storage.Writer {
+	w := obj.NewWriter(ctx)
+	w.ContentType = srcObjectAttrs.ContentType
+	if c.options.ContentType != "" {
+		w.ContentType = c.options.ContentType
+	}
+	w.ContentEncoding = c.contentEncoding()
+	w.KMSKeyName = c.options.KMSKeyName
+	if c.options.ChunkSize > 0 {
+		w.ChunkSize = c.options.ChunkSize
+	}
+	w.Metadata = c.destinationMetadata(ctx, srcObjectAttrs)
+	return w
+}
+
+// customTime returns the custom time of the destination object: with
+// Options.PreserveCustomTime the custom time of the source object or, if not set, its
+// creation time. Otherwise the zero time, which leaves it unset
+func (c *Workflow) customTime(srcObjectAttrs *storage.ObjectAttrs) time.Time {
+	if !c.options.PreserveCustomTime {
+		return time.Time{}
+	}
+	if !srcObjectAttrs.CustomTime.IsZero() {
+		return srcObjectAttrs.CustomTime
+	}
+	return srcObjectAttrs.Created
+}
+
+// destinationMetadata returns the custom metadata of the destination object or nil if none
+func (c *Workflow) destinationMetadata(ctx context.Context, srcObjectAttrs *storage.ObjectAttrs) map[string]string {
+	metadata := make(map[string]string)
+
+	if c.options.StoreOriginalSize {
+		metadata[UncompressedSizeMetadataKey] = strconv.FormatInt(srcObjectAttrs.Size, 10)
+		// use the same big-endian base64 encoding GCS uses for CRC32C checksums
+		if srcObjectAttrs.CRC32C != 0 {
+			metadata[UncompressedCRC32CMetadataKey] = encodeCRC32C(srcObjectAttrs.CRC32C)
+		}
+	}
+
+	if c.options.StoreSourceChecksums {
+		metadata[SourceCRC32CMetadataKey] = encodeCRC32C(srcObjectAttrs.CRC32C)
+		// composite objects have no MD5
+		if len(srcObjectAttrs.MD5) > 0 {
+			metadata[SourceMD5MetadataKey] = base64.StdEncoding.EncodeToString(srcObjectAttrs.MD5)
+		}
+	}
+
+	if c.contentEncoding() == "" {
+		metadata[CodecMetadataKey] = c.codec().Name
+	}
+
+	if c.options.TagProducer {
+		metadata[ProducerMetadataKey] = producer(ctx)
+	}
+
+	if len(metadata) == 0 {
+		return nil
+	}
+	return metadata
+}
+
+// producer returns host name and worker name of ctx as 'host/worker'. The host name is
+// the pod name on Kubernetes
+func producer(ctx context.Context) string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return host + "/" + GetWorkerName(ctx)
+}
+
+func encodeCRC32C(crc uint32) string {
+	return base64.StdEncoding.EncodeToString(binary.BigEndian.AppendUint32(nil, crc))
+}
+
+// objectCompressionLevel returns the compression level set in the metadata of the source
+// object or, if not set or invalid, the level of Options.LevelBySize for its size or else
+// the compression level of the workflow
+func (c *Workflow) objectCompressionLevel(ctx context.Context, attrs *storage.ObjectAttrs) int {
+	defaultLevel, ok := levelForSize(c.options.LevelBySize, attrs.Size)
+	if !ok {
+		defaultLevel = c.compressionLevel
+	}
+
+	value, ok := attrs.Metadata[CompressionLevelMetadataKey]
+	if !ok {
+		return defaultLevel
+	}
+
+	level, err := strconv.Atoi(value)
+	level, ok = c.codec().Level(level)
+	if err != nil || !ok {
+		log.Printf("%s - '%s' warning: ignoring invalid %s '%s', using compression level %d", GetWorkerName(ctx), c.srcObject.ObjectName(), CompressionLevelMetadataKey, value, defaultLevel)
+		return defaultLevel
+	}
+
+	return level
+}
+
+// copy copies the source object verbatim to the destination without compressing it
+func (c *Workflow) copy(ctx context.Context, srcObjectAttrs *storage.ObjectAttrs) error {
+	workerName := GetWorkerName(ctx)
+
+	log.Printf("%s - '%s' copying object uncompressed from bucket '%s' to '%s/%s'", workerName, c.srcObject.ObjectName(), c.srcObject.BucketName(), c.dstObject.BucketName(), c.dstObject.ObjectName())
+	copier := c.dstObject.CopierFrom(c.srcObject)
+	copier.DestinationKMSKeyName = c.options.KMSKeyName
+	copier.PredefinedACL = c.options.PredefinedACL
+	copier.StorageClass = c.options.StorageClass
+	copier.CustomTime = c.customTime(srcObjectAttrs)
+	if _, err := copier.Run(ctx); err != nil {
+		return accessError(fmt.Errorf("failed to copy object: %w", err), opWriteDestination, c.dstObject.BucketName())
+	}
 
 	return nil
 }
 
+// retentionReason describes why the source object is retained or returns an empty string
+// if it is not, or its attributes cannot be read
+func (c *Workflow) retentionReason(ctx context.Context) string {
+	attrs, err := c.srcObject.Attrs(ctx)
+	if err != nil {
+		return ""
+	}
+
+	switch {
+	case attrs.TemporaryHold:
+		return "temporary hold is set"
+	case attrs.EventBasedHold:
+		return "event-based hold is set"
+	case attrs.RetentionExpirationTime.After(time.Now()):
+		return fmt.Sprintf("retention policy expires at %s", attrs.RetentionExpirationTime.Format(time.RFC3339))
+	case attrs.Retention != nil && attrs.Retention.RetainUntil.After(time.Now()):
+		return fmt.Sprintf("object retention expires at %s", attrs.Retention.RetainUntil.Format(time.RFC3339))
+	}
+	return ""
+}
+
+// DestinationName returns the name of the destination object, which Compress may have
+// prefixed with a date partition
+func (c *Workflow) DestinationName() string {
+	return c.dstObject.ObjectName()
+}
+
+// DestinationBucket returns the bucket of the destination object, which Compress may have
+// changed by Options.MetadataRoutes
+func (c *Workflow) DestinationBucket() string {
+	return c.dstObject.BucketName()
+}
+
+// dstObjectExists reports whether the destination object or any of its replicas exists
 func (c *Workflow) dstObjectExists(ctx context.Context) bool {
-	_, err := c.dstObject.Attrs(ctx)
-	return err == nil
+	for _, obj := range c.destinationObjects() {
+		if _, err := obj.Attrs(ctx); err == nil {
+			return true
+		}
+	}
+	return false
 }
 
-func (c *Workflow) Delete(ctx context.Context) error {
+// SignedURL returns a V4 signed URL to download the destination object, valid for the
+// given duration. Signing requires service account credentials or the permission to
+// sign blobs as the service account (roles/iam.serviceAccountTokenCreator)
+func (c *Workflow) SignedURL(ctx context.Context, expires time.Duration) (string, error) {
+	url, err := c.dstBucket(c.dstObject.BucketName()).SignedURL(c.dstObject.ObjectName(), &storage.SignedURLOptions{
+		Scheme:  storage.SigningSchemeV4,
+		Method:  "GET",
+		Expires: time.Now().Add(expires),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to sign URL for destination object: %w", err)
+	}
+	return url, nil
+}
+
+// Delete deletes the source object. A source object under a hold or retention policy
+// returns ErrSourceRetained. A source object that did not get smaller by compression is
+// kept unless Options.DeleteOnInflation is set. With Options.InPlace the source is the
+// compressed object and is not deleted
+func (c *Workflow) Delete(ctx context.Context) (err error) {
+	ctx, span := tracer.Start(ctx, "Delete", trace.WithAttributes(objectAttributes(c.srcObject, c.dstObject)...))
+	defer func() { endSpan(span, err) }()
+
 	workerName := GetWorkerName(ctx)
 
+	if c.options.InPlace {
+		log.Printf("%s - '%s' source file in bucket %s was replaced in place, nothing to delete", workerName, c.srcObject.ObjectName(), c.srcObject.BucketName())
+		return nil
+	}
+
+	if c.inflated && !c.options.DeleteOnInflation {
+		log.Printf("%s - '%s' warning: compressed object is not smaller than the source, keeping the source file in bucket %s", workerName, c.srcObject.ObjectName(), c.srcObject.BucketName())
+		return nil
+	}
+
 	log.Printf("%s - '%s' initiating deletion of source file in bucket %s", workerName, c.srcObject.ObjectName(), c.srcObject.BucketName())
 	if err := c.srcObject.Delete(ctx); err != nil {
-		return fmt.Errorf("error deleting source file: %w", err)
+		if reason := c.retentionReason(ctx); reason != "" {
+			return fmt.Errorf("%w: %s", ErrSourceRetained, reason)
+		}
+		return accessError(fmt.Errorf("error deleting source file: %w", err), opDeleteSource, c.srcObject.BucketName())
 	}
 	log.Printf("%s - '%s' source file in bucket %s successfully deleted", workerName, c.srcObject.ObjectName(), c.srcObject.BucketName())
 
 	return nil
 }
+
+// contextReader stops reading as soon as the context is done. This aborts a
+// long running copy promptly instead of waiting for the underlying reader
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// countingReader adds the bytes read to n
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,262 @@
+package core
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompressReadErrorLeavesNoDestination(t *testing.T) {
+	f := newFakeStorage(t)
+	data := make([]byte, 1<<20)
+	rand.Read(data)
+	f.put("src", "data.bin", data, fakeAttrs{})
+	// the source is deleted after half of it was read
+	f.truncate[key("src", "data.bin")] = len(data) / 2
+
+	wf := newTestWorkflow(t, "src", "data.bin", "dst", "data.bin.gz", Options{})
+	if _, err := wf.Compress(context.Background()); err == nil {
+		t.Fatal("Compress succeeded reading a truncated source")
+	}
+	if names := f.names("dst"); len(names) > 0 {
+		t.Errorf("destination holds %v after the failed compression", names)
+	}
+}
+
+func TestCompressMissingSource(t *testing.T) {
+	f := newFakeStorage(t)
+
+	wf := newTestWorkflow(t, "src", "gone.log", "dst", "gone.log.gz", Options{})
+	if _, err := wf.Compress(context.Background()); !errors.Is(err, ErrSourceGone) {
+		t.Fatalf("Compress returned %v, want ErrSourceGone", err)
+	}
+	if names := f.names("dst"); len(names) > 0 {
+		t.Errorf("destination holds %v for a missing source", names)
+	}
+}
+
+func TestCompressEmptySource(t *testing.T) {
+	f := newFakeStorage(t)
+	f.put("src", "empty.log", nil, fakeAttrs{ContentType: "text/plain"})
+
+	wf := newTestWorkflow(t, "src", "empty.log", "dst", "empty.log.gz", Options{SkipEmpty: true})
+	if _, err := wf.Compress(context.Background()); !errors.Is(err, ErrObjectEmpty) {
+		t.Fatalf("Compress with SkipEmpty returned %v, want ErrObjectEmpty", err)
+	}
+	if names := f.names("dst"); len(names) > 0 {
+		t.Errorf("destination holds %v after skipping the empty source", names)
+	}
+
+	wf = newTestWorkflow(t, "src", "empty.log", "dst", "empty.log.gz", Options{})
+	result, err := wf.Compress(context.Background())
+	if err != nil {
+		t.Fatalf("Compress: %v", err)
+	}
+	if result.CopyReason != CopyReasonEmpty {
+		t.Errorf("CopyReason is '%s', want '%s'", result.CopyReason, CopyReasonEmpty)
+	}
+	obj, ok := f.object("dst", "empty.log.gz")
+	if !ok {
+		t.Fatal("no destination object was written")
+	}
+	if len(obj.data) != 0 || obj.contentEncoding != "" {
+		t.Errorf("destination has %d bytes and Content-Encoding '%s', want an empty copy", len(obj.data), obj.contentEncoding)
+	}
+}
+
+func TestCompressStreamInvalidLevel(t *testing.T) {
+	for _, tt := range []struct {
+		codec string
+		level int
+	}{
+		{"gzip", 10},
+		{"gzip", -3},
+		{"deflate", 42},
+	} {
+		codec, _ := LookupCodec(tt.codec)
+		var out bytes.Buffer
+		n, err := CompressStream(context.Background(), &out, strings.NewReader("2024-01-01 INFO request served\n"), codec, tt.level, 0)
+		if err == nil {
+			t.Errorf("%s level %d: CompressStream succeeded, want an error", tt.codec, tt.level)
+		}
+		if n != -1 || out.Len() > 0 {
+			t.Errorf("%s level %d: CompressStream read %d bytes and wrote %d bytes, want nothing", tt.codec, tt.level, n, out.Len())
+		}
+	}
+}
+
+// pipeWriter hands writes to a goroutine like storage.Writer and counts them
+type pipeWriter struct {
+	*io.PipeWriter
+	writes int
+	done   chan struct{}
+}
+
+func newPipeWriter() *pipeWriter {
+	pr, pw := io.Pipe()
+	w := &pipeWriter{PipeWriter: pw, done: make(chan struct{})}
+	go func() {
+		io.Copy(io.Discard, pr)
+		close(w.done)
+	}()
+	return w
+}
+
+func (w *pipeWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return w.PipeWriter.Write(p)
+}
+
+func BenchmarkCompressStream(b *testing.B) {
+	var data bytes.Buffer
+	for i := 0; data.Len() < 256<<10; i++ {
+		fmt.Fprintf(&data, `{"id":%d,"level":"INFO","message":"request served","path":"/api/v1/items/%d"}`+"\n", i, i%100)
+	}
+
+	for _, bufferSize := range []int{0, 1 << 20} {
+		b.Run(fmt.Sprintf("bufferSize=%d", bufferSize), func(b *testing.B) {
+			b.SetBytes(int64(data.Len()))
+			var writes int
+			for range b.N {
+				w := newPipeWriter()
+				if _, err := CompressStream(context.Background(), w, bytes.NewReader(data.Bytes()), DefaultCodec, DefaultCodec.DefaultLevel, bufferSize); err != nil {
+					b.Fatal(err)
+				}
+				w.Close()
+				<-w.done
+				writes += w.writes
+			}
+			b.ReportMetric(float64(writes)/float64(b.N), "writes/op")
+		})
+	}
+}
+
+// patternReader returns an endless repetition of a log line without allocating
+type patternReader struct {
+	offset int
+}
+
+var logLine = []byte("2024-01-01T00:00:00Z INFO GET /api/v1/items 200 12ms\n")
+
+func (r *patternReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = logLine[r.offset]
+		r.offset = (r.offset + 1) % len(logLine)
+	}
+	return len(p), nil
+}
+
+func TestCompressStreamMemoryIsBounded(t *testing.T) {
+	if testing.Short() {
+		t.Skip("streams 256 MiB")
+	}
+	const size = 256 << 20
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	n, err := CompressStream(context.Background(), io.Discard, io.LimitReader(&patternReader{}, size), DefaultCodec, 1, 0)
+	runtime.ReadMemStats(&after)
+	if err != nil || n != size {
+		t.Fatalf("CompressStream read %d bytes and returned %v, want %d bytes", n, err, size)
+	}
+
+	// the codec state and copy buffer are allocated once, independent of the input size
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 8<<20 {
+		t.Errorf("streaming %d MiB allocated %d MiB", size>>20, allocated>>20)
+	}
+}
+
+func TestCompressOnExisting(t *testing.T) {
+	data := bytes.Repeat([]byte("2024-01-01 INFO request served\n"), 1000)
+	existing := []byte("existing")
+	tests := []struct {
+		policy  ExistingPolicy
+		wantErr error
+		want    []byte
+	}{
+		{OnExistingError, ErrDestinationExists, existing},
+		{OnExistingSkip, ErrDestinationSkipped, existing},
+		{OnExistingOverwrite, nil, data},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			f := newFakeStorage(t)
+			f.put("src", "app.log", data, fakeAttrs{})
+			f.put("dst", "app.log.gz", existing, fakeAttrs{})
+
+			wf := newTestWorkflow(t, "src", "app.log", "dst", "app.log.gz", Options{OnExisting: tt.policy})
+			if _, err := wf.Compress(context.Background()); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Compress returned %v, want %v", err, tt.wantErr)
+			}
+			obj, _ := f.object("dst", "app.log.gz")
+			got := obj.data
+			if tt.wantErr == nil {
+				got = gunzip(t, got)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("destination holds %q, want %q", got[:min(len(got), 16)], tt.want[:min(len(tt.want), 16)])
+			}
+		})
+	}
+}
+
+func TestCompressDeterministic(t *testing.T) {
+	data := bytes.Repeat([]byte("2024-01-01 INFO request served\n"), 1000)
+	for _, deterministic := range []bool{false, true} {
+		t.Run(fmt.Sprintf("deterministic=%t", deterministic), func(t *testing.T) {
+			f := newFakeStorage(t)
+			f.put("src", "a/app.log", data, fakeAttrs{})
+			f.put("src", "b/other.log", data, fakeAttrs{})
+
+			options := Options{GzipHeaderName: "{name}", Deterministic: deterministic}
+			var outputs [][]byte
+			for _, name := range []string{"a/app.log", "b/other.log"} {
+				wf := newTestWorkflow(t, "src", name, "dst", name+".gz", options)
+				if _, err := wf.Compress(context.Background()); err != nil {
+					t.Fatalf("Compress: %v", err)
+				}
+				obj, _ := f.object("dst", name+".gz")
+				outputs = append(outputs, obj.data)
+			}
+
+			r, err := gzip.NewReader(bytes.NewReader(outputs[0]))
+			if err != nil {
+				t.Fatalf("gzip.NewReader: %v", err)
+			}
+			wantName := "app.log"
+			if deterministic {
+				wantName = ""
+			}
+			if r.Name != wantName || !r.ModTime.IsZero() || r.OS != 255 {
+				t.Errorf("header has name '%s', modification time %v and OS %d, want name '%s', no modification time and OS 255", r.Name, r.ModTime, r.OS, wantName)
+			}
+			if identical := bytes.Equal(outputs[0], outputs[1]); identical != deterministic {
+				t.Errorf("objects of different sources are identical: %t, want %t", identical, deterministic)
+			}
+		})
+	}
+}
+
+func TestCompressExpandsDateOfSource(t *testing.T) {
+	f := newFakeStorage(t)
+	src := f.put("src", "logs/app.log", []byte("2024-01-01 INFO request served\n"), fakeAttrs{})
+	// {date} is the creation date of the source, not the date of processing
+	src.created = time.Date(2024, 3, 5, 23, 30, 0, 0, time.UTC)
+
+	wf := newTestWorkflow(t, "src", "logs/app.log", "dst", ExpandTemplate("{date}/{object}.gz", "logs/app.log", time.Time{}), Options{})
+	if _, err := wf.Compress(context.Background()); err != nil {
+		t.Fatalf("Compress: %v", err)
+	}
+	if names := f.names("dst"); len(names) != 1 || names[0] != "2024-03-05/logs/app.log.gz" {
+		t.Errorf("destination bucket holds %v, want 2024-03-05/logs/app.log.gz", names)
+	}
+}
@@ -0,0 +1,128 @@
+package core
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ErrCorruptSource is returned by Decompress when the source object is no valid GZIP
+// stream, e.g. its checksum does not match
+var ErrCorruptSource = errors.New("source object is corrupt")
+
+// Decompress writes the decompressed content of the GZIP compressed source object to
+// the destination object. The source object is read as stored, so GCS does not
+// transcode it, and is not deleted
+func (c *Workflow) Decompress(ctx context.Context) (Result, error) {
+	ctx, span := tracer.Start(ctx, "Decompress", trace.WithAttributes(objectAttributes(c.srcObject, c.dstObject)...))
+	result, err := c.decompress(ctx)
+	span.SetAttributes(resultAttributes(result)...)
+	endSpan(span, err)
+
+	return result, err
+}
+
+func (c *Workflow) decompress(ctx context.Context) (Result, error) {
+	workerName := GetWorkerName(ctx)
+	start := time.Now()
+
+	srcReader, err := c.srcObject.ReadCompressed(true).NewReader(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return Result{}, ErrSourceGone
+	}
+	if err != nil {
+		return Result{}, accessError(fmt.Errorf("failed to open source object: %w", err), opReadSource, c.srcObject.BucketName())
+	}
+	defer srcReader.Close()
+
+	srcObjectAttrs, err := c.srcObject.Attrs(ctx)
+	if err != nil {
+		return Result{}, accessError(fmt.Errorf("cannot read source object metadata: %w", err), opReadSource, c.srcObject.BucketName())
+	}
+
+	if c.options.OnExisting != OnExistingOverwrite && c.dstObjectExists(ctx) {
+		return Result{}, existingError(c.options.OnExisting)
+	}
+
+	// concatenated GZIP members, e.g. of parallel compressions, are read as one stream
+	gzipReader, err := gzip.NewReader(&contextReader{ctx: ctx, r: srcReader})
+	if isCorrupt(err) {
+		return Result{}, c.corruptError(err)
+	}
+	if err != nil {
+		return Result{}, fmt.Errorf("source object is not GZIP compressed: %w", err)
+	}
+
+	// canceling the writer context aborts the upload
+	wctx, wcancel := context.WithCancel(ctx)
+	defer wcancel()
+
+	dstWriter := c.dstObject.NewWriter(wctx)
+	dstWriter.ContentType = srcObjectAttrs.ContentType
+	if c.options.ContentType != "" {
+		dstWriter.ContentType = c.options.ContentType
+	}
+	dstWriter.KMSKeyName = c.options.KMSKeyName
+	dstWriter.PredefinedACL = c.options.PredefinedACL
+	dstWriter.TemporaryHold = c.options.TemporaryHold
+	dstWriter.EventBasedHold = c.options.EventBasedHold
+	dstWriter.StorageClass = c.options.StorageClass
+	if c.options.ChunkSize > 0 {
+		dstWriter.ChunkSize = c.options.ChunkSize
+	}
+
+	log.Printf("%s - '%s' reading file from bucket '%s' and writing decompressed to '%s/%s'", workerName, c.srcObject.ObjectName(), c.srcObject.BucketName(), c.dstObject.BucketName(), c.dstObject.ObjectName())
+	// the checksum of each GZIP member is verified by the last read, not by Close, so
+	// corrupt content surfaces as error of the copy
+	n, err := io.Copy(dstWriter, gzipReader)
+	if err == nil {
+		err = gzipReader.Close()
+	}
+	if err != nil {
+		wcancel()
+		dstWriter.Close()
+		if isCorrupt(err) {
+			return Result{}, c.corruptError(err)
+		}
+		return Result{}, accessError(fmt.Errorf("failed to decompress and upload object: %w", err), opWriteDestination, c.dstObject.BucketName())
+	}
+	if err := dstWriter.Close(); err != nil {
+		return Result{}, accessError(fmt.Errorf("failed to finalize destination object: %w", err), opWriteDestination, c.dstObject.BucketName())
+	}
+
+	var ratio float64
+	if srcObjectAttrs.Size > 0 {
+		ratio = float64(n) / float64(srcObjectAttrs.Size)
+	}
+	elapsed := time.Since(start)
+	log.Printf("%s - '%s' decompressed %d bytes to %d bytes in %s/%s. Took %s", workerName, c.srcObject.ObjectName(), srcObjectAttrs.Size, n, c.dstObject.BucketName(), c.dstObject.ObjectName(), elapsed.Round(time.Millisecond))
+
+	return Result{
+		BytesIn:  srcObjectAttrs.Size,
+		BytesOut: n,
+		Ratio:    ratio,
+		Codec:    "gzip",
+		Duration: elapsed,
+	}, nil
+}
+
+// isCorrupt reports whether the error is caused by invalid GZIP content rather than by
+// reading or writing it
+func isCorrupt(err error) bool {
+	var corruptInput flate.CorruptInputError
+	return errors.Is(err, gzip.ErrChecksum) || errors.Is(err, gzip.ErrHeader) || errors.As(err, &corruptInput)
+}
+
+// corruptError identifies the corrupt source object. The cause is not wrapped, so the error
+// is not classified as retryable
+func (c *Workflow) corruptError(err error) error {
+	return fmt.Errorf("%w: '%s/%s' cannot be decompressed, restore it from a backup or delete it: %v", ErrCorruptSource, c.srcObject.BucketName(), c.srcObject.ObjectName(), err)
+}
@@ -0,0 +1,100 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"cloud.google.com/go/storage"
+)
+
+// DownloadPartSize is the size in bytes of the byte ranges of a parallel download. Each
+// range in flight is buffered in memory
+const DownloadPartSize = 16 << 20
+
+// rangePart is a downloaded byte range of an object
+type rangePart struct {
+	data []byte
+	err  error
+}
+
+// rangeReader reads an object in byte ranges downloaded concurrently and returns them
+// in order, so a single stream consumer like a GZIP writer is fed faster than by one
+// download stream
+type rangeReader struct {
+	parts  chan chan rangePart
+	cancel context.CancelFunc
+	cur    []byte
+	err    error
+}
+
+// newRangeReader starts downloading size bytes of obj in DownloadPartSize ranges with up
+// to parallelism ranges ahead of the reader. obj should be pinned to a generation so all
+// ranges are read from the same object
+func newRangeReader(ctx context.Context, obj *storage.ObjectHandle, size int64, parallelism int) *rangeReader {
+	ctx, cancel := context.WithCancel(ctx)
+	r := &rangeReader{
+		// a part channel is queued per range in flight
+		parts:  make(chan chan rangePart, parallelism-1),
+		cancel: cancel,
+	}
+
+	go func() {
+		defer close(r.parts)
+		for offset := int64(0); offset < size; offset += DownloadPartSize {
+			part := make(chan rangePart, 1)
+			select {
+			case r.parts <- part:
+			case <-ctx.Done():
+				return
+			}
+			go func(offset, length int64) {
+				part <- downloadRange(ctx, obj, offset, length)
+			}(offset, min(DownloadPartSize, size-offset))
+		}
+	}()
+
+	return r
+}
+
+func downloadRange(ctx context.Context, obj *storage.ObjectHandle, offset, length int64) rangePart {
+	reader, err := obj.NewRangeReader(ctx, offset, length)
+	if err != nil {
+		return rangePart{err: fmt.Errorf("failed to open source range at offset %d: %w", offset, err)}
+	}
+	defer reader.Close()
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return rangePart{err: fmt.Errorf("failed to read source range at offset %d: %w", offset, err)}
+	}
+	return rangePart{data: data}
+}
+
+func (r *rangeReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if len(r.cur) == 0 {
+		part, ok := <-r.parts
+		if !ok {
+			r.err = io.EOF
+			return 0, r.err
+		}
+		result := <-part
+		if result.err != nil {
+			r.err = result.err
+			return 0, r.err
+		}
+		r.cur = result.data
+	}
+	n := copy(p, r.cur)
+	r.cur = r.cur[n:]
+	return n, nil
+}
+
+// Close stops all downloads in flight
+func (r *rangeReader) Close() error {
+	r.cancel()
+	return nil
+}
@@ -0,0 +1,100 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"cloud.google.com/go/storage"
+)
+
+// newTestObject returns a handle of an object of the fake storage pinned to its generation
+func newTestObject(t testing.TB, f *fakeStorage, name string, data []byte) *storage.ObjectHandle {
+	t.Helper()
+	obj := f.put("src", name, data, fakeAttrs{})
+	client, err := storage.NewClient(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client.Bucket("src").Object(name).Generation(obj.generation)
+}
+
+func TestRangeReader(t *testing.T) {
+	// two full parts and a short last one
+	data := make([]byte, 2*DownloadPartSize+12345)
+	rand.Read(data)
+
+	for _, parallelism := range []int{2, 8} {
+		t.Run(fmt.Sprintf("parallelism=%d", parallelism), func(t *testing.T) {
+			f := newFakeStorage(t)
+			obj := newTestObject(t, f, "data.bin", data)
+
+			r := newRangeReader(context.Background(), obj, int64(len(data)), parallelism)
+			defer r.Close()
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("reading ranges: %v", err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("read %d bytes differing from the %d bytes of the object", len(got), len(data))
+			}
+		})
+	}
+}
+
+func TestRangeReaderError(t *testing.T) {
+	data := make([]byte, 3*DownloadPartSize)
+	rand.Read(data)
+	f := newFakeStorage(t)
+	obj := newTestObject(t, f, "data.bin", data)
+	f.failRange[key("src", "data.bin")] = DownloadPartSize
+
+	r := newRangeReader(context.Background(), obj, int64(len(data)), 4)
+	defer r.Close()
+	got, err := io.ReadAll(r)
+	if !errors.Is(err, storage.ErrObjectNotExist) {
+		t.Fatalf("reading ranges returned %v, want %v", err, storage.ErrObjectNotExist)
+	}
+	// the ranges before the failed one are returned in full, none after it
+	if !bytes.Equal(got, data[:DownloadPartSize]) {
+		t.Errorf("read %d bytes before the error, want the %d bytes of the first range", len(got), DownloadPartSize)
+	}
+	if _, again := r.Read(make([]byte, 1)); again != err {
+		t.Errorf("reading after the error returned %v, want %v", again, err)
+	}
+}
+
+func BenchmarkRangeReader(b *testing.B) {
+	data := make([]byte, 4*DownloadPartSize)
+	rand.Read(data)
+	f := newFakeStorage(b)
+	obj := newTestObject(b, f, "data.bin", data)
+
+	for _, parallelism := range []int{1, 4} {
+		b.Run(fmt.Sprintf("parallelism=%d", parallelism), func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for range b.N {
+				var r io.ReadCloser
+				if parallelism == 1 {
+					// a single download stream, as without -downloadParallelism
+					reader, err := obj.NewReader(context.Background())
+					if err != nil {
+						b.Fatal(err)
+					}
+					r = reader
+				} else {
+					r = newRangeReader(context.Background(), obj, int64(len(data)), parallelism)
+				}
+				if _, err := io.Copy(io.Discard, r); err != nil {
+					b.Fatal(err)
+				}
+				r.Close()
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+// TestEmulatorCompressAndDelete runs against a storage emulator like fake-gcs-server,
+// see test-emulator.sh. It is skipped unless STORAGE_EMULATOR_HOST is set
+func TestEmulatorCompressAndDelete(t *testing.T) {
+	if os.Getenv("STORAGE_EMULATOR_HOST") == "" {
+		t.Skip("STORAGE_EMULATOR_HOST is not set")
+	}
+
+	ctx := context.Background()
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		t.Fatalf("storage.NewClient: %v", err)
+	}
+	defer client.Close()
+
+	suffix := time.Now().UnixNano()
+	srcBucket, dstBucket := fmt.Sprintf("source-%d", suffix), fmt.Sprintf("destination-%d", suffix)
+	for _, bucket := range []string{srcBucket, dstBucket} {
+		err := client.Bucket(bucket).Create(ctx, "project", nil)
+		var apiErr *googleapi.Error
+		if err != nil && !(errors.As(err, &apiErr) && apiErr.Code == http.StatusConflict) {
+			t.Fatalf("creating bucket '%s': %v", bucket, err)
+		}
+	}
+
+	data := bytes.Repeat([]byte("2024-01-01 INFO request served\n"), 100000)
+	w := client.Bucket(srcBucket).Object("app.log").NewWriter(ctx)
+	w.ContentType = "text/plain"
+	if _, err := w.Write(data); err != nil {
+		t.Fatalf("writing source object: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("writing source object: %v", err)
+	}
+
+	wf := newTestWorkflow(t, srcBucket, "app.log", dstBucket, "app.log.gz", Options{})
+	if _, err := wf.Compress(ctx); err != nil {
+		t.Fatalf("Compress: %v", err)
+	}
+	if err := wf.Delete(ctx); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+
+	// read the stored bytes to not depend on transcoding of the emulator
+	r, err := client.Bucket(dstBucket).Object("app.log.gz").ReadCompressed(true).NewReader(ctx)
+	if err != nil {
+		t.Fatalf("reading destination object: %v", err)
+	}
+	compressed, err := io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatalf("reading destination object: %v", err)
+	}
+	if !bytes.Equal(gunzip(t, compressed), data) {
+		t.Error("destination does not decompress to the source")
+	}
+
+	if _, err := client.Bucket(srcBucket).Object("app.log").Attrs(ctx); !errors.Is(err, storage.ErrObjectNotExist) {
+		t.Errorf("reading the source object returned %v, want ErrObjectNotExist", err)
+	}
+}
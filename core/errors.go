@@ -0,0 +1,68 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+// ErrPermissionDenied is returned when GCS rejects an operation with 403. The error names
+// the operation, the bucket and the missing IAM permission. It is not retryable
+var ErrPermissionDenied = errors.New("permission denied")
+
+// ErrUserProjectRequired is returned when a requester-pays bucket is accessed without
+// Options.UserProject. It is not retryable
+var ErrUserProjectRequired = errors.New("bucket is requester-pays and requires a user project")
+
+// operations of a workflow and the IAM permission they need
+const (
+	opReadSource       = "read source object"
+	opReadDestination  = "read destination object"
+	opWriteDestination = "write destination object"
+	opDeleteSource     = "delete source object"
+)
+
+var opPermissions = map[string]string{
+	opReadSource:       "storage.objects.get",
+	opReadDestination:  "storage.objects.get",
+	opWriteDestination: "storage.objects.create",
+	opDeleteSource:     "storage.objects.delete",
+}
+
+// accessError returns an ErrPermissionDenied error naming operation, bucket and the
+// missing permission if err is a 403 of GCS, an ErrUserProjectRequired error if the bucket
+// is requester-pays, and err otherwise
+func accessError(err error, operation, bucket string) error {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return err
+	}
+	switch {
+	case apiErr.Code == http.StatusForbidden:
+		return fmt.Errorf("%w to %s in bucket '%s', the principal needs %s on it: %w", ErrPermissionDenied, operation, bucket, opPermissions[operation], err)
+	case apiErr.Code == http.StatusBadRequest && strings.Contains(strings.ToLower(apiErr.Message), "requester pays"):
+		return fmt.Errorf("%w: cannot %s in bucket '%s', set the project to bill, e.g. via -userProject: %w", ErrUserProjectRequired, operation, bucket, err)
+	}
+	return err
+}
+
+// IsCanceled reports whether the error is caused by a canceled or timed out context,
+// however deeply it is wrapped
+func IsCanceled(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// IsRetryable reports whether processing the object again may succeed, i.e. the error is
+// caused by cancellation or is a transient GCS error such as a rate limit or server error.
+// Missing permissions and user projects are never retryable
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, ErrPermissionDenied) || errors.Is(err, ErrUserProjectRequired) {
+		return false
+	}
+	return IsCanceled(err) || storage.ShouldRetry(err)
+}
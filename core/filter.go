@@ -0,0 +1,76 @@
+package core
+
+import (
+	"net/url"
+	"strings"
+)
+
+// ParseList splits a comma-separated list and drops empty entries
+func ParseList(list string) []string {
+	var values []string
+	for _, v := range strings.Split(list, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// HasExtension reports whether the object name ends with one of the extensions,
+// given with or without leading dot. An empty list matches all object names
+func HasExtension(objectName string, extensions []string) bool {
+	if len(extensions) == 0 {
+		return true
+	}
+
+	for _, ext := range extensions {
+		if strings.HasSuffix(objectName, "."+strings.TrimPrefix(ext, ".")) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchContentType reports whether the content type, ignoring parameters such as charset,
+// matches one of the patterns: a media type, e.g. application/json, or a type with wildcard
+// subtype, e.g. text/*. Matching is case-insensitive
+func MatchContentType(contentType string, patterns []string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if prefix, ok := strings.CutSuffix(pattern, "/*"); ok {
+			if strings.HasPrefix(mediaType, prefix+"/") {
+				return true
+			}
+			continue
+		}
+		if mediaType == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// GlobPrefix returns the literal prefix of a glob pattern up to the first wildcard, which
+// narrows the listing of objects matching the pattern
+func GlobPrefix(pattern string) string {
+	if i := strings.IndexAny(pattern, `*?[\`); i >= 0 {
+		return pattern[:i]
+	}
+	return pattern
+}
+
+// NormalizeObjectName decodes URL-encoded object names of notifications, e.g. "a%20b.txt".
+// Names without valid escapes are returned unchanged. '+' is kept, as it is no encoding of
+// a space in paths
+func NormalizeObjectName(objectName string) string {
+	if !strings.Contains(objectName, "%") {
+		return objectName
+	}
+	decoded, err := url.PathUnescape(objectName)
+	if err != nil {
+		return objectName
+	}
+	return decoded
+}
@@ -0,0 +1,29 @@
+package core
+
+import "testing"
+
+func TestNormalizeObjectName(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"plain", "logs/app.log", "logs/app.log"},
+		{"encoded space", "logs/my%20file.txt", "logs/my file.txt"},
+		{"raw space", "logs/my file.txt", "logs/my file.txt"},
+		{"plus is kept", "logs/a+b.txt", "logs/a+b.txt"},
+		{"encoded plus", "logs/a%2Bb.txt", "logs/a+b.txt"},
+		{"encoded slash", "logs%2Fapp.log", "logs/app.log"},
+		{"encoded unicode", "logs/%C3%BCber%20%E6%97%A5%E6%9C%AC.txt", "logs/über 日本.txt"},
+		{"raw unicode", "logs/über 日本.txt", "logs/über 日本.txt"},
+		{"invalid escape", "logs/100%.txt", "logs/100%.txt"},
+		{"incomplete escape", "logs/a%2.txt", "logs/a%2.txt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NormalizeObjectName(tt.in); got != tt.want {
+				t.Errorf("NormalizeObjectName(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+// compressInPlace compresses the source object to a temporary object and copies it onto the
+// source name. The copy only succeeds if the source is still the generation that was read,
+// so an upload racing the compression is kept instead of being replaced by stale content
+func (c *Workflow) compressInPlace(ctx context.Context, srcObjectAttrs *storage.ObjectAttrs, srcReader io.Reader, start time.Time) (Result, error) {
+	workerName := GetWorkerName(ctx)
+
+	// copying an object onto itself would change nothing
+	switch {
+	case srcObjectAttrs.Size == 0:
+		return Result{}, fmt.Errorf("%w: object is empty", ErrInPlaceSkipped)
+	case srcObjectAttrs.Size < c.options.MinSize:
+		return Result{}, fmt.Errorf("%w: object is smaller than the minimum size", ErrInPlaceSkipped)
+	case len(c.options.CopyExtensions) > 0 && HasExtension(c.srcObject.ObjectName(), c.options.CopyExtensions):
+		return Result{}, fmt.Errorf("%w: object has a copy extension", ErrInPlaceSkipped)
+	case srcObjectAttrs.ContentEncoding != "" && srcObjectAttrs.ContentEncoding != "identity":
+		// also the object written by an earlier in-place compression
+		log.Printf("%s - '%s' source object has Content-Encoding '%s' already, keeping it", workerName, c.srcObject.ObjectName(), srcObjectAttrs.ContentEncoding)
+		return Result{}, fmt.Errorf("%w: object has Content-Encoding '%s'", ErrInPlaceSkipped, srcObjectAttrs.ContentEncoding)
+	}
+
+	target := c.dstObject
+	if target.BucketName() != c.srcObject.BucketName() || target.ObjectName() != c.srcObject.ObjectName() {
+		return Result{}, fmt.Errorf("in-place compression requires the destination '%s/%s' to be the source object", target.BucketName(), target.ObjectName())
+	}
+	name := fmt.Sprintf("%s%sinplace-%d", target.ObjectName(), TempPartMarker, srcObjectAttrs.Generation)
+	temp := c.dstBucket(target.BucketName()).Object(name)
+	c.dstObject = temp
+	defer func() { c.dstObject = target }()
+	defer c.deleteParts(ctx, []*storage.ObjectHandle{temp})
+
+	level := c.objectCompressionLevel(ctx, srcObjectAttrs)
+	reader := c.sourceReader(ctx, srcObjectAttrs, srcReader)
+	bytesProcessed, err := c.compressStream(ctx, srcObjectAttrs, reader, level)
+	reader.Close()
+	if err != nil {
+		return Result{}, err
+	}
+
+	tempAttrs, err := temp.Attrs(ctx)
+	if err != nil {
+		return Result{}, accessError(fmt.Errorf("failed to read temporary object metadata: %w", err), opReadDestination, temp.BucketName())
+	}
+
+	var compressionRatio float64
+	if tempAttrs.Size > 0 {
+		compressionRatio = float64(srcObjectAttrs.Size) / float64(tempAttrs.Size)
+	}
+	if tempAttrs.Size >= srcObjectAttrs.Size && !c.options.DeleteOnInflation {
+		log.Printf("%s - '%s' warning: compressed object is not smaller than the source, keeping the source uncompressed", workerName, c.srcObject.ObjectName())
+		return Result{}, fmt.Errorf("%w: compressed object is not smaller", ErrInPlaceSkipped)
+	}
+	if c.options.MinRatio > 0 && compressionRatio < c.options.MinRatio {
+		log.Printf("%s - '%s' compression ratio %.2f is below minimum ratio %.2f, keeping the source uncompressed", workerName, c.srcObject.ObjectName(), compressionRatio, c.options.MinRatio)
+		return Result{}, fmt.Errorf("%w: %.2f < %.2f", ErrLowRatio, compressionRatio, c.options.MinRatio)
+	}
+
+	copier := target.If(storage.Conditions{GenerationMatch: srcObjectAttrs.Generation}).CopierFrom(temp.Generation(tempAttrs.Generation))
+	// attributes set on the copier replace those of the temporary object
+	copier.ContentType = tempAttrs.ContentType
+	copier.ContentEncoding = tempAttrs.ContentEncoding
+	copier.Metadata = tempAttrs.Metadata
+	copier.CustomTime = c.customTime(srcObjectAttrs)
+	copier.DestinationKMSKeyName = c.options.KMSKeyName
+	copier.PredefinedACL = c.options.PredefinedACL
+	copier.TemporaryHold = c.options.TemporaryHold
+	copier.EventBasedHold = c.options.EventBasedHold
+	copier.StorageClass = c.options.StorageClass
+	_, err = copier.Run(ctx)
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusPreconditionFailed {
+		log.Printf("%s - '%s' source object changed while compressing, keeping the newer generation", workerName, c.srcObject.ObjectName())
+		return Result{}, fmt.Errorf("%w: generation %d is not current anymore", ErrSourceChanged, srcObjectAttrs.Generation)
+	}
+	if err != nil {
+		return Result{}, accessError(fmt.Errorf("failed to replace source object: %w", err), opWriteDestination, target.BucketName())
+	}
+
+	elapsed := time.Since(start)
+	log.Printf("%s - '%s' compressed %d bytes to %d bytes in place in %s/%s with %s level %d. Compression ratio %.2f. Took %s", workerName, c.srcObject.ObjectName(), bytesProcessed, tempAttrs.Size, target.BucketName(), target.ObjectName(), c.codec().Name, level, compressionRatio, elapsed.Round(time.Millisecond))
+
+	return Result{
+		BytesIn:  bytesProcessed,
+		BytesOut: tempAttrs.Size,
+		Ratio:    compressionRatio,
+		Codec:    c.codec().Name,
+		Duration: elapsed,
+	}, nil
+}
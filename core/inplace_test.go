@@ -0,0 +1,83 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestCompressInPlace(t *testing.T) {
+	f := newFakeStorage(t)
+	data := bytes.Repeat([]byte("2024-01-01 INFO request served\n"), 10000)
+	f.put("bucket", "app.log", data, fakeAttrs{ContentType: "text/plain"})
+
+	wf := newTestWorkflow(t, "bucket", "app.log", "bucket", "app.log", Options{InPlace: true})
+	if _, err := wf.Compress(context.Background()); err != nil {
+		t.Fatalf("Compress: %v", err)
+	}
+	if err := wf.Delete(context.Background()); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+
+	obj, ok := f.object("bucket", "app.log")
+	if !ok {
+		t.Fatal("object was deleted")
+	}
+	if obj.contentEncoding != "gzip" || obj.contentType != "text/plain" {
+		t.Errorf("object has Content-Encoding '%s' and Content-Type '%s', want gzip and text/plain", obj.contentEncoding, obj.contentType)
+	}
+	if !bytes.Equal(gunzip(t, obj.data), data) {
+		t.Error("object does not decompress to the original content")
+	}
+	if names := f.names("bucket"); len(names) != 1 {
+		t.Errorf("bucket holds %v, want only the object", names)
+	}
+
+	// the notification of the replaced object is skipped
+	wf = newTestWorkflow(t, "bucket", "app.log", "bucket", "app.log", Options{InPlace: true})
+	if _, err := wf.Compress(context.Background()); !errors.Is(err, ErrInPlaceSkipped) {
+		t.Errorf("compressing the replaced object returned %v, want ErrInPlaceSkipped", err)
+	}
+}
+
+func TestCompressInPlaceSourceChanged(t *testing.T) {
+	f := newFakeStorage(t)
+	f.put("bucket", "app.log", bytes.Repeat([]byte("old line\n"), 10000), fakeAttrs{})
+
+	// a new upload lands while the temporary object is written
+	newer := []byte("new content")
+	f.onCreate = func(bucket, name string) {
+		if IsTempPart(name) {
+			f.put("bucket", "app.log", newer, fakeAttrs{})
+		}
+	}
+
+	wf := newTestWorkflow(t, "bucket", "app.log", "bucket", "app.log", Options{InPlace: true})
+	if _, err := wf.Compress(context.Background()); !errors.Is(err, ErrSourceChanged) {
+		t.Fatalf("Compress returned %v, want ErrSourceChanged", err)
+	}
+
+	obj, _ := f.object("bucket", "app.log")
+	if !bytes.Equal(obj.data, newer) || obj.contentEncoding != "" {
+		t.Error("the newer upload was replaced")
+	}
+	if names := f.names("bucket"); len(names) != 1 {
+		t.Errorf("bucket holds %v, want only the object", names)
+	}
+}
+
+func TestCompressInPlaceOtherDestination(t *testing.T) {
+	f := newFakeStorage(t)
+	f.put("bucket", "app.log", bytes.Repeat([]byte("line\n"), 10000), fakeAttrs{})
+	f.put("bucket", "other.log", []byte("other"), fakeAttrs{})
+
+	wf := newTestWorkflow(t, "bucket", "app.log", "bucket", "other.log", Options{InPlace: true})
+	_, err := wf.Compress(context.Background())
+	if err == nil || errors.Is(err, ErrSourceChanged) {
+		t.Fatalf("Compress returned %v, want an error for a destination other than the source", err)
+	}
+	if obj, _ := f.object("bucket", "other.log"); string(obj.data) != "other" {
+		t.Error("the other object was replaced")
+	}
+}
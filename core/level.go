@@ -0,0 +1,92 @@
+package core
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// SizeLevel is the compression level of objects of up to MaxSize bytes
+type SizeLevel struct {
+	MaxSize int64
+	Level   int
+}
+
+// size units of ParseLevelBySize
+var sizeUnits = []struct {
+	suffix string
+	bytes  int64
+}{
+	{"KiB", 1 << 10},
+	{"MiB", 1 << 20},
+	{"GiB", 1 << 30},
+	{"TiB", 1 << 40},
+	{"KB", 1e3},
+	{"MB", 1e6},
+	{"GB", 1e9},
+	{"TB", 1e12},
+	{"B", 1},
+}
+
+// ParseLevelBySize parses a comma-separated list of size:level thresholds in ascending order,
+// e.g. "1MB:1,100MB:6,+:9". Objects of up to the size use the level, '+' matches all larger
+// objects and may only be last. Sizes are bytes or have a unit of B, KB, MB, GB, TB or
+// KiB, MiB, GiB, TiB. Levels are not validated against a codec
+func ParseLevelBySize(policy string) ([]SizeLevel, error) {
+	var levels []SizeLevel
+	for _, entry := range ParseList(policy) {
+		if len(levels) > 0 && levels[len(levels)-1].MaxSize == math.MaxInt64 {
+			return nil, fmt.Errorf("'+' needs to be the last threshold, found '%s' after it", entry)
+		}
+
+		size, level, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, fmt.Errorf("threshold '%s' is not of the form size:level", entry)
+		}
+
+		l, err := strconv.Atoi(strings.TrimSpace(level))
+		if err != nil {
+			return nil, fmt.Errorf("level '%s' of threshold '%s' is not a number", level, entry)
+		}
+
+		maxSize := int64(math.MaxInt64)
+		if size = strings.TrimSpace(size); size != "+" {
+			if maxSize, err = parseSize(size); err != nil {
+				return nil, fmt.Errorf("size of threshold '%s': %w", entry, err)
+			}
+			if len(levels) > 0 && maxSize <= levels[len(levels)-1].MaxSize {
+				return nil, fmt.Errorf("threshold '%s' is not larger than the previous one", entry)
+			}
+		}
+
+		levels = append(levels, SizeLevel{MaxSize: maxSize, Level: l})
+	}
+	return levels, nil
+}
+
+func parseSize(size string) (int64, error) {
+	unit := int64(1)
+	for _, u := range sizeUnits {
+		if number, ok := strings.CutSuffix(size, u.suffix); ok {
+			size, unit = strings.TrimSpace(number), u.bytes
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(size, 64)
+	if err != nil || n < 0 || n*float64(unit) >= math.MaxInt64 {
+		return 0, fmt.Errorf("'%s' is no valid size", size)
+	}
+	return int64(n * float64(unit)), nil
+}
+
+// levelForSize returns the level of the first threshold the size does not exceed
+func levelForSize(levels []SizeLevel, size int64) (int, bool) {
+	for _, l := range levels {
+		if size <= l.MaxSize {
+			return l.Level, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,67 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// ListObjects calls fn for each object under the prefix, skipping folder placeholders and
+// temporary parts. Objects last updated before Options.ModifiedAfter are skipped and
+// counted. Objects are listed page by page, so they are never held in memory at once
+func ListObjects(ctx context.Context, bucketName, prefix string, options Options, fn func(objectName string) error) (skipped int, err error) {
+	return listObjects(ctx, bucketName, &storage.Query{Prefix: prefix}, options, func(attrs *storage.ObjectAttrs) error {
+		return fn(attrs.Name)
+	})
+}
+
+// ListNoncurrent calls fn for each noncurrent version of objects under the prefix of a
+// versioned bucket, skipping live versions, like ListObjects
+func ListNoncurrent(ctx context.Context, bucketName, prefix string, options Options, fn func(objectName string, generation int64) error) (skipped int, err error) {
+	return listObjects(ctx, bucketName, &storage.Query{Prefix: prefix, Versions: true}, options, func(attrs *storage.ObjectAttrs) error {
+		// live versions have no deletion time
+		if attrs.Deleted.IsZero() {
+			return nil
+		}
+		return fn(attrs.Name, attrs.Generation)
+	})
+}
+
+func listObjects(ctx context.Context, bucketName string, query *storage.Query, options Options, fn func(attrs *storage.ObjectAttrs) error) (skipped int, err error) {
+	client, err := storage.NewClient(ctx, options.SourceClientOptions...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create GCS client: %v", err)
+	}
+	defer client.Close()
+
+	it := client.Bucket(bucketName).UserProject(options.UserProject).Objects(ctx, query)
+	for {
+		attrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			return skipped, nil
+		}
+		if err != nil {
+			return skipped, fmt.Errorf("failed to list source objects: %w", err)
+		}
+
+		if strings.HasSuffix(attrs.Name, "/") || IsTempPart(attrs.Name) {
+			continue
+		}
+
+		if attrs.Updated.Before(options.ModifiedAfter) {
+			log.Printf("%s - '%s' skipping object last modified %s before %s", GetWorkerName(ctx), attrs.Name, attrs.Updated.Format(time.RFC3339), options.ModifiedAfter.Format(time.RFC3339))
+			skipped++
+			continue
+		}
+
+		if err := fn(attrs); err != nil {
+			return skipped, err
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/sync/errgroup"
+)
+
+// MaxParallelChunks is the maximum number of parts of a parallel compression,
+// limited by the number of source objects of a GCS compose request
+const MaxParallelChunks = 32
+
+// TempPartMarker is part of the names of the temporary objects written by a parallel
+// compression. Consumers of bucket notifications should ignore objects containing it
+const TempPartMarker = ".gcs-compressor-part-"
+
+// TempStorageClass is the storage class of temporary objects, which has no minimum
+// storage duration
+const TempStorageClass = "STANDARD"
+
+// IsTempPart reports whether the object is a temporary part of a parallel compression
+func IsTempPart(objectName string) bool {
+	return strings.Contains(objectName, TempPartMarker)
+}
+
+// compressParallel compresses byte ranges of the source object concurrently to temporary
+// objects next to the destination and composes them into the destination object. As GZIP
+// members (and snappy streams) can be concatenated the result is a valid stream. The temporary objects are
+// deleted afterwards
+func (c *Workflow) compressParallel(ctx context.Context, srcObjectAttrs *storage.ObjectAttrs, level int) (int64, error) {
+	workerName := GetWorkerName(ctx)
+
+	chunks := int64(min(c.options.ParallelChunks, MaxParallelChunks))
+	chunkSize := (srcObjectAttrs.Size + chunks - 1) / chunks
+
+	var parts []*storage.ObjectHandle
+	for offset := int64(0); offset < srcObjectAttrs.Size; offset += chunkSize {
+		name := fmt.Sprintf("%s%s%d", c.dstObject.ObjectName(), TempPartMarker, len(parts))
+		parts = append(parts, c.dstBucket(c.dstObject.BucketName()).Object(name))
+	}
+	defer c.deleteParts(ctx, parts)
+
+	log.Printf("%s - '%s' reading file from bucket '%s' and writing compressed in %d parts to '%s/%s'", workerName, c.srcObject.ObjectName(), c.srcObject.BucketName(), len(parts), c.dstObject.BucketName(), c.dstObject.ObjectName())
+
+	codec := c.streamCodec(ctx, srcObjectAttrs)
+	sizes := make([]int64, len(parts))
+	g, gctx := errgroup.WithContext(ctx)
+	for i, part := range parts {
+		g.Go(func() error {
+			n, err := c.compressRange(gctx, part, srcObjectAttrs, int64(i)*chunkSize, chunkSize, codec, level)
+			sizes[i] = n
+			return err
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return -1, err
+	}
+
+	composer := c.dstObject.ComposerFrom(parts...)
+	composer.ContentType = srcObjectAttrs.ContentType
+	if c.options.ContentType != "" {
+		composer.ContentType = c.options.ContentType
+	}
+	composer.ContentEncoding = c.contentEncoding()
+	composer.KMSKeyName = c.options.KMSKeyName
+	composer.PredefinedACL = c.options.PredefinedACL
+	composer.Metadata = c.destinationMetadata(ctx, srcObjectAttrs)
+	composer.StorageClass = c.options.StorageClass
+	composer.CustomTime = c.customTime(srcObjectAttrs)
+	if _, err := composer.Run(ctx); err != nil {
+		return -1, accessError(fmt.Errorf("failed to compose destination object: %w", err), opWriteDestination, c.dstObject.BucketName())
+	}
+
+	var n int64
+	for _, size := range sizes {
+		n += size
+	}
+	return n, nil
+}
+
+// compressRange compresses length bytes of the source object starting at offset into part
+func (c *Workflow) compressRange(ctx context.Context, part *storage.ObjectHandle, srcObjectAttrs *storage.ObjectAttrs, offset, length int64, codec Codec, level int) (int64, error) {
+	srcReader, err := c.srcObject.Generation(srcObjectAttrs.Generation).NewRangeReader(ctx, offset, length)
+	if err != nil {
+		return -1, accessError(fmt.Errorf("failed to open source object range at %d: %w", offset, err), opReadSource, c.srcObject.BucketName())
+	}
+	defer srcReader.Close()
+
+	// canceling the writer context aborts the upload of the part
+	wctx, wcancel := context.WithCancel(ctx)
+	defer wcancel()
+
+	partWriter := c.newTempWriter(wctx, part, srcObjectAttrs)
+	partWriter.Metadata = nil
+	abort := func(err error) (int64, error) {
+		wcancel()
+		partWriter.Close()
+		return -1, err
+	}
+
+	n, err := CompressStream(ctx, partWriter, srcReader, codec, level, 0)
+	if err != nil {
+		return abort(fmt.Errorf("failed to compress and upload part '%s': %w", part.ObjectName(), err))
+	}
+	if err := partWriter.Close(); err != nil {
+		return -1, accessError(fmt.Errorf("failed to finalize part '%s': %w", part.ObjectName(), err), opWriteDestination, c.dstObject.BucketName())
+	}
+
+	return n, nil
+}
+
+// deleteParts removes the temporary objects of a parallel compression. Parts that were
+// never written are ignored
+func (c *Workflow) deleteParts(ctx context.Context, parts []*storage.ObjectHandle) {
+	// clean up even if the workflow context was canceled
+	ctx = context.WithoutCancel(ctx)
+	for _, part := range parts {
+		if err := part.Delete(ctx); err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+			log.Printf("%s - '%s' failed to delete temporary part '%s': %v", GetWorkerName(ctx), c.srcObject.ObjectName(), part.ObjectName(), err)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+func TestTemporaryObjectsAreStandard(t *testing.T) {
+	tests := []struct {
+		name    string
+		options Options
+	}{
+		{"parallel parts", Options{ParallelChunks: 4, StorageClass: "COLDLINE"}},
+		{"append temporary object", Options{Append: true, StorageClass: "ARCHIVE"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeStorage(t)
+			// parts need to be STANDARD explicitly, not by the bucket default
+			f.defaultStorageClass = "NEARLINE"
+			data := bytes.Repeat([]byte("id,name,value\n"), 50000)
+			f.put("src", "data.csv", data, fakeAttrs{ContentType: "text/csv"})
+
+			wf := newTestWorkflow(t, "src", "data.csv", "dst", "data.csv.gz", tt.options)
+			if _, err := wf.Compress(context.Background()); err != nil {
+				t.Fatalf("Compress: %v", err)
+			}
+
+			var temps int
+			for _, obj := range f.created {
+				want := tt.options.StorageClass
+				if IsTempPart(obj.name) {
+					want = TempStorageClass
+					temps++
+				}
+				if obj.bucket == "dst" && obj.storageClass != want {
+					t.Errorf("object '%s' has storage class %s, want %s", obj.name, obj.storageClass, want)
+				}
+			}
+			if temps == 0 {
+				t.Error("no temporary objects were written")
+			}
+
+			if names := f.names("dst"); len(names) != 1 || names[0] != "data.csv.gz" {
+				t.Errorf("destination bucket holds %v, want only the destination object", names)
+			}
+			dst, _ := f.object("dst", "data.csv.gz")
+			if !bytes.Equal(gunzip(t, dst.data), data) {
+				t.Error("destination does not decompress to the source")
+			}
+		})
+	}
+}
+
+func TestParallelStreamsEncodedSources(t *testing.T) {
+	f := newFakeStorage(t)
+	data := bytes.Repeat([]byte("id,name,value\n"), 50000)
+	f.put("src", "data.csv", compress(t, DefaultCodec, DefaultCodec.DefaultLevel, data), fakeAttrs{ContentType: "text/csv", ContentEncoding: "gzip"})
+
+	// byte ranges of an encoded object are not ranges of its content
+	wf := newTestWorkflow(t, "src", "data.csv", "dst", "data.csv.gz", Options{ParallelChunks: 4, CompressEncoded: true})
+	if _, err := wf.Compress(context.Background()); err != nil {
+		t.Fatalf("Compress: %v", err)
+	}
+
+	for _, obj := range f.created {
+		if IsTempPart(obj.name) {
+			t.Errorf("temporary part '%s' was written for an encoded source", obj.name)
+		}
+	}
+	dst, _ := f.object("dst", "data.csv.gz")
+	if !bytes.Equal(gunzip(t, dst.data), data) {
+		t.Error("destination does not decompress to the decoded source")
+	}
+}
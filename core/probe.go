@@ -0,0 +1,59 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+// ProbeObjectName is the object written and deleted by CheckDestination. It contains
+// TempPartMarker, so it is ignored like temporary parts
+const ProbeObjectName = TempPartMarker + "probe"
+
+// CheckDestination verifies that the destination bucket exists and, with write set,
+// that an object can be written to and deleted from it
+func CheckDestination(ctx context.Context, bucketName string, write bool, options Options) error {
+	client, err := storage.NewClient(ctx, options.DestinationClientOptions...)
+	if err != nil {
+		return fmt.Errorf("failed to create GCS client: %v", err)
+	}
+	defer client.Close()
+
+	// reading bucket metadata requires storage.buckets.get, which e.g. Storage Object User
+	// lacks. Without it the bucket is assumed to exist
+	bucket := client.Bucket(bucketName).UserProject(options.UserProject)
+	_, err = bucket.Attrs(ctx)
+	var apiErr *googleapi.Error
+	switch {
+	case errors.Is(err, storage.ErrBucketNotExist):
+		return fmt.Errorf("destination bucket '%s' does not exist", bucketName)
+	case errors.As(err, &apiErr) && apiErr.Code == http.StatusForbidden:
+		log.Printf("no permission to read destination bucket '%s', skipping existence check", bucketName)
+	case err != nil:
+		return fmt.Errorf("cannot read destination bucket '%s': %w", bucketName, err)
+	}
+
+	if !write {
+		return nil
+	}
+
+	obj := bucket.Object(ProbeObjectName)
+	w := obj.NewWriter(ctx)
+	w.KMSKeyName = options.KMSKeyName
+	if _, err := w.Write([]byte("probe")); err != nil {
+		w.Close()
+		return fmt.Errorf("cannot write to destination bucket '%s': %w", bucketName, err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("cannot write to destination bucket '%s': %w", bucketName, err)
+	}
+	if err := obj.Delete(ctx); err != nil {
+		return fmt.Errorf("cannot delete from destination bucket '%s': %w", bucketName, err)
+	}
+	return nil
+}
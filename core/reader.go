@@ -0,0 +1,27 @@
+package core
+
+import (
+	"context"
+	"io"
+)
+
+// CompressReader returns a reader of the source object compressed with the codec of the
+// workflow, e.g. to proxy compressed downloads. Nothing is written to the destination. The
+// source is compressed while the reader is consumed; closing the reader early stops it
+func (c *Workflow) CompressReader(ctx context.Context) (io.ReadCloser, error) {
+	srcReader, srcObjectAttrs, err := c.openSource(ctx)
+	if err != nil {
+		return nil, err
+	}
+	level := c.objectCompressionLevel(ctx, srcObjectAttrs)
+
+	pr, pw := io.Pipe()
+	go func() {
+		defer srcReader.Close()
+		_, err := CompressStream(ctx, pw, srcReader, c.streamCodec(ctx, srcObjectAttrs), level, c.options.GzipBufferSize)
+		// a nil error closes the reader with io.EOF
+		pw.CloseWithError(err)
+	}()
+
+	return pr, nil
+}
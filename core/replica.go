@@ -0,0 +1,75 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"cloud.google.com/go/storage"
+)
+
+// destinationObjects returns the destination object followed by its replicas in
+// Options.ReplicaBuckets, all with the same object name
+func (c *Workflow) destinationObjects() []*storage.ObjectHandle {
+	objs := []*storage.ObjectHandle{c.dstObject}
+	for _, bucketName := range c.options.ReplicaBuckets {
+		objs = append(objs, c.dstBucket(bucketName).Object(c.dstObject.ObjectName()))
+	}
+	return objs
+}
+
+// replicate copies the written destination object server-side to the replica buckets. If a
+// copy fails, the destination object and the replicas written so far are deleted
+func (c *Workflow) replicate(ctx context.Context) error {
+	objs := c.destinationObjects()
+	for i, replica := range objs[1:] {
+		log.Printf("%s - '%s' copying '%s/%s' to replica bucket '%s'", GetWorkerName(ctx), c.srcObject.ObjectName(), c.dstObject.BucketName(), c.dstObject.ObjectName(), replica.BucketName())
+		copier := replica.CopierFrom(c.dstObject)
+		copier.DestinationKMSKeyName = c.options.KMSKeyName
+		copier.PredefinedACL = c.options.PredefinedACL
+		copier.StorageClass = c.options.StorageClass
+		if _, err := copier.Run(ctx); err != nil {
+			c.deleteWritten(ctx, objs[:i+1])
+			return accessError(fmt.Errorf("failed to copy destination object to replica bucket '%s': %w", replica.BucketName(), err), opWriteDestination, replica.BucketName())
+		}
+	}
+	return nil
+}
+
+// deleteWritten removes destination objects written before writing another destination
+// failed, so no destination is left with an object the others lack, or that are not kept
+func (c *Workflow) deleteWritten(ctx context.Context, objs []*storage.ObjectHandle) {
+	// clean up even if the workflow context was canceled
+	ctx = context.WithoutCancel(ctx)
+	for _, obj := range objs {
+		err := obj.Delete(ctx)
+		if err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+			log.Printf("%s - '%s' failed to delete '%s/%s': %v", GetWorkerName(ctx), c.srcObject.ObjectName(), obj.BucketName(), obj.ObjectName(), err)
+			continue
+		}
+		log.Printf("%s - '%s' deleted '%s/%s'", GetWorkerName(ctx), c.srcObject.ObjectName(), obj.BucketName(), obj.ObjectName())
+	}
+}
+
+// holdDestinations places the holds of the options on the destination object and its
+// replicas. It is called once all of them are kept, as held objects cannot be deleted
+func (c *Workflow) holdDestinations(ctx context.Context) error {
+	if !c.options.TemporaryHold && !c.options.EventBasedHold {
+		return nil
+	}
+
+	var attrs storage.ObjectAttrsToUpdate
+	if c.options.TemporaryHold {
+		attrs.TemporaryHold = true
+	}
+	if c.options.EventBasedHold {
+		attrs.EventBasedHold = true
+	}
+	for _, obj := range c.destinationObjects() {
+		if _, err := obj.Update(ctx, attrs); err != nil {
+			return accessError(fmt.Errorf("failed to place hold on destination object '%s/%s': %w", obj.BucketName(), obj.ObjectName(), err), opWriteDestination, obj.BucketName())
+		}
+	}
+	return nil
+}
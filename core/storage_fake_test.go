@@ -0,0 +1,624 @@
+package core
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeObject is an object stored by fakeStorage
+type fakeObject struct {
+	bucket          string
+	name            string
+	data            []byte
+	generation      int64
+	metageneration  int64
+	contentType     string
+	contentEncoding string
+	storageClass    string
+	metadata        map[string]string
+	created         time.Time
+	customTime      time.Time
+	temporaryHold   bool
+	eventBasedHold  bool
+}
+
+// fakeStorage is an in-memory GCS serving the subset of the JSON and XML API the storage
+// client uses for reads, uploads, copies, composes, updates, deletes and listings. Storage
+// clients created after newFakeStorage talk to it via STORAGE_EMULATOR_HOST
+type fakeStorage struct {
+	srv *httptest.Server
+
+	mu         sync.Mutex
+	objects    map[string]*fakeObject
+	uploads    map[string]*fakeUpload
+	generation int64
+	// created records the storage class of every object written, in order
+	created []fakeObject
+	// onCreate is called after an object was written, e.g. to race a workflow
+	onCreate func(bucket, name string)
+	// defaultStorageClass is the storage class of objects written without one
+	defaultStorageClass string
+	// truncate stops downloads of an object after the given number of bytes. Resuming
+	// the download fails as if the object was deleted meanwhile
+	truncate map[string]int
+	// failRange fails ranged downloads of an object starting at the given offset as if
+	// the object was deleted meanwhile
+	failRange map[string]int64
+}
+
+// fakeUpload is a resumable upload in progress
+type fakeUpload struct {
+	attrs  fakeAttrs
+	query  url.Values
+	bucket string
+	data   []byte
+}
+
+// fakeAttrs is the object resource of requests
+type fakeAttrs struct {
+	Name            string            `json:"name"`
+	ContentType     string            `json:"contentType"`
+	ContentEncoding string            `json:"contentEncoding"`
+	StorageClass    string            `json:"storageClass"`
+	Metadata        map[string]string `json:"metadata"`
+	CustomTime      string            `json:"customTime"`
+	TemporaryHold   bool              `json:"temporaryHold"`
+	EventBasedHold  bool              `json:"eventBasedHold"`
+}
+
+func newFakeStorage(t testing.TB) *fakeStorage {
+	f := &fakeStorage{
+		objects:             make(map[string]*fakeObject),
+		uploads:             make(map[string]*fakeUpload),
+		truncate:            make(map[string]int),
+		failRange:           make(map[string]int64),
+		defaultStorageClass: "STANDARD",
+	}
+	f.srv = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	t.Cleanup(f.srv.Close)
+	t.Setenv("STORAGE_EMULATOR_HOST", f.srv.URL)
+	return f
+}
+
+func key(bucket, name string) string {
+	return bucket + "/" + name
+}
+
+// put stores an object like an upload would
+func (f *fakeStorage) put(bucket, name string, data []byte, attrs fakeAttrs) *fakeObject {
+	f.mu.Lock()
+	obj := f.store(bucket, name, data, attrs)
+	f.mu.Unlock()
+	return obj
+}
+
+// store needs f.mu to be held
+func (f *fakeStorage) store(bucket, name string, data []byte, attrs fakeAttrs) *fakeObject {
+	f.generation++
+	obj := &fakeObject{
+		bucket:          bucket,
+		name:            name,
+		data:            data,
+		generation:      f.generation,
+		metageneration:  1,
+		contentType:     attrs.ContentType,
+		contentEncoding: attrs.ContentEncoding,
+		storageClass:    attrs.StorageClass,
+		metadata:        attrs.Metadata,
+		created:         time.Now(),
+		temporaryHold:   attrs.TemporaryHold,
+		eventBasedHold:  attrs.EventBasedHold,
+	}
+	if obj.storageClass == "" {
+		obj.storageClass = f.defaultStorageClass
+	}
+	if attrs.CustomTime != "" {
+		obj.customTime, _ = time.Parse(time.RFC3339Nano, attrs.CustomTime)
+	}
+	f.objects[key(bucket, name)] = obj
+	f.created = append(f.created, *obj)
+	return obj
+}
+
+// object returns a copy of the stored object
+func (f *fakeStorage) object(bucket, name string) (fakeObject, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	obj, ok := f.objects[key(bucket, name)]
+	if !ok {
+		return fakeObject{}, false
+	}
+	return *obj, true
+}
+
+// names returns the sorted names of the objects in bucket
+func (f *fakeStorage) names(bucket string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.namesLocked(bucket)
+}
+
+func (f *fakeStorage) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	var segments []string
+	for _, s := range strings.Split(strings.Trim(r.URL.EscapedPath(), "/"), "/") {
+		s, _ = url.PathUnescape(s)
+		segments = append(segments, s)
+	}
+
+	switch {
+	case len(segments) >= 6 && segments[0] == "upload" && segments[1] == "storage" && segments[3] == "b":
+		f.upload(w, r, segments[4])
+	case len(segments) == 3 && segments[0] == "upload" && segments[1] == "resumable":
+		f.resumeUpload(w, r, segments[2])
+	case len(segments) >= 4 && segments[0] == "storage" && segments[1] == "v1" && segments[2] == "b":
+		f.serveJSON(w, r, segments[3:])
+	case len(segments) >= 2:
+		f.download(w, r, segments[0], strings.Join(segments[1:], "/"))
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// serveJSON serves b/{bucket}/o/... of the JSON API
+func (f *fakeStorage) serveJSON(w http.ResponseWriter, r *http.Request, segments []string) {
+	bucket := segments[0]
+	switch {
+	case len(segments) == 2 && r.Method == http.MethodGet:
+		f.list(w, r, bucket)
+	case len(segments) == 3 && r.Method == http.MethodGet && r.URL.Query().Get("alt") == "media":
+		f.download(w, r, bucket, segments[2])
+	case len(segments) == 3 && r.Method == http.MethodGet:
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		obj, ok := f.lookup(w, r, bucket, segments[2])
+		if ok {
+			writeJSON(w, http.StatusOK, obj.resource())
+		}
+	case len(segments) == 3 && r.Method == http.MethodDelete:
+		f.delete(w, r, bucket, segments[2])
+	case len(segments) == 3 && r.Method == http.MethodPatch:
+		f.patch(w, r, bucket, segments[2])
+	case len(segments) == 4 && segments[3] == "compose":
+		f.compose(w, r, bucket, segments[2])
+	case len(segments) == 8 && segments[3] == "rewriteTo":
+		f.rewrite(w, r, bucket, segments[2], segments[5], segments[7])
+	default:
+		writeError(w, http.StatusNotImplemented, fmt.Sprintf("%s %s is not supported by the fake", r.Method, r.URL.Path))
+	}
+}
+
+// lookup returns the object, pinned to the generation of the request if any, or writes a 404.
+// f.mu needs to be held
+func (f *fakeStorage) lookup(w http.ResponseWriter, r *http.Request, bucket, name string) (*fakeObject, bool) {
+	obj, ok := f.objects[key(bucket, name)]
+	if gen := r.URL.Query().Get("generation"); ok && gen != "" && gen != strconv.FormatInt(obj.generation, 10) {
+		ok = false
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("No such object: %s/%s", bucket, name))
+	}
+	return obj, ok
+}
+
+// preconditionsMet checks ifGenerationMatch and ifGenerationNotMatch against the current
+// object or writes a 412. f.mu needs to be held
+func (f *fakeStorage) preconditionsMet(w http.ResponseWriter, r *http.Request, bucket, name string) bool {
+	var current int64
+	if obj, ok := f.objects[key(bucket, name)]; ok {
+		current = obj.generation
+	}
+	q := r.URL.Query()
+	if v := q.Get("ifGenerationMatch"); v != "" && v != strconv.FormatInt(current, 10) {
+		writeError(w, http.StatusPreconditionFailed, "At least one of the pre-conditions you specified did not hold.")
+		return false
+	}
+	if v := q.Get("ifGenerationNotMatch"); v != "" && v == strconv.FormatInt(current, 10) {
+		writeError(w, http.StatusPreconditionFailed, "At least one of the pre-conditions you specified did not hold.")
+		return false
+	}
+	return true
+}
+
+// notify calls onCreate, outside of the lock
+func (f *fakeStorage) notify(bucket, name string) {
+	if f.onCreate != nil {
+		f.onCreate(bucket, name)
+	}
+}
+
+func (f *fakeStorage) download(w http.ResponseWriter, r *http.Request, bucket, name string) {
+	f.mu.Lock()
+	obj, ok := f.lookup(w, r, bucket, name)
+	if !ok {
+		f.mu.Unlock()
+		return
+	}
+	o := *obj
+	limit, truncated := f.truncate[key(bucket, name)]
+	failOffset, fail := f.failRange[key(bucket, name)]
+	f.mu.Unlock()
+	if (truncated && r.Header.Get("Range") != "") || (fail && strings.HasPrefix(r.Header.Get("Range"), fmt.Sprintf("bytes=%d-", failOffset))) {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("No such object: %s/%s", bucket, name))
+		return
+	}
+
+	h := w.Header()
+	h.Set("X-Goog-Generation", strconv.FormatInt(o.generation, 10))
+	h.Set("X-Goog-Metageneration", strconv.FormatInt(o.metageneration, 10))
+	h.Set("Content-Type", o.contentType)
+	h.Set("Last-Modified", o.created.UTC().Format(http.TimeFormat))
+	if o.contentEncoding != "" {
+		// served as stored, the client decompresses unless it asked for the encoding
+		h.Set("Content-Encoding", o.contentEncoding)
+		h.Set("X-Goog-Stored-Content-Encoding", o.contentEncoding)
+	}
+
+	data, status := o.data, http.StatusOK
+	if rng := r.Header.Get("Range"); strings.HasPrefix(rng, "bytes=") {
+		start, end := parseRange(strings.TrimPrefix(rng, "bytes="), int64(len(o.data)))
+		if start >= int64(len(o.data)) && len(o.data) > 0 {
+			writeError(w, http.StatusRequestedRangeNotSatisfiable, "range not satisfiable")
+			return
+		}
+		data, status = o.data[start:end], http.StatusPartialContent
+		h.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end-1, len(o.data)))
+	}
+	h.Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(status)
+	if truncated && limit < len(data) {
+		// the connection is closed as less than the announced length was written
+		data = data[:limit]
+	}
+	if r.Method != http.MethodHead {
+		w.Write(data)
+	}
+}
+
+// parseRange returns the byte range [start, end) of a Range header value
+func parseRange(rng string, size int64) (int64, int64) {
+	first, last, _ := strings.Cut(rng, "-")
+	if first == "" {
+		n, _ := strconv.ParseInt(last, 10, 64)
+		return max(size-n, 0), size
+	}
+	start, _ := strconv.ParseInt(first, 10, 64)
+	end := size
+	if last != "" {
+		l, _ := strconv.ParseInt(last, 10, 64)
+		end = min(l+1, size)
+	}
+	return start, end
+}
+
+func (f *fakeStorage) upload(w http.ResponseWriter, r *http.Request, bucket string) {
+	q := r.URL.Query()
+	switch q.Get("uploadType") {
+	case "multipart":
+		_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		mr := multipart.NewReader(r.Body, params["boundary"])
+		var attrs fakeAttrs
+		var data []byte
+		for i := 0; ; i++ {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			if i == 0 {
+				err = json.NewDecoder(part).Decode(&attrs)
+			} else {
+				data, err = io.ReadAll(part)
+			}
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+		}
+		f.finishUpload(w, r, bucket, attrs, data)
+	case "resumable":
+		var attrs fakeAttrs
+		if err := json.NewDecoder(r.Body).Decode(&attrs); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		f.mu.Lock()
+		f.generation++
+		id := strconv.FormatInt(f.generation, 10)
+		f.uploads[id] = &fakeUpload{attrs: attrs, query: q, bucket: bucket}
+		f.mu.Unlock()
+		w.Header().Set("Location", f.srv.URL+"/upload/resumable/"+id)
+		w.WriteHeader(http.StatusOK)
+	default:
+		writeError(w, http.StatusBadRequest, "unsupported uploadType")
+	}
+}
+
+func (f *fakeStorage) resumeUpload(w http.ResponseWriter, r *http.Request, id string) {
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	f.mu.Lock()
+	upload, ok := f.uploads[id]
+	if !ok {
+		f.mu.Unlock()
+		writeError(w, http.StatusNotFound, "no such upload")
+		return
+	}
+	upload.data = append(upload.data, data...)
+	final := !strings.HasSuffix(r.Header.Get("Content-Range"), "/*")
+	if final {
+		delete(f.uploads, id)
+	}
+	f.mu.Unlock()
+
+	if !final {
+		w.Header().Set("X-Http-Status-Code-Override", "308")
+		w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(upload.data)-1))
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	r.URL.RawQuery = upload.query.Encode()
+	f.finishUpload(w, r, upload.bucket, upload.attrs, upload.data)
+}
+
+func (f *fakeStorage) finishUpload(w http.ResponseWriter, r *http.Request, bucket string, attrs fakeAttrs, data []byte) {
+	f.mu.Lock()
+	if !f.preconditionsMet(w, r, bucket, attrs.Name) {
+		f.mu.Unlock()
+		return
+	}
+	obj := f.store(bucket, attrs.Name, data, attrs)
+	resource := obj.resource()
+	f.mu.Unlock()
+
+	f.notify(bucket, attrs.Name)
+	writeJSON(w, http.StatusOK, resource)
+}
+
+func (f *fakeStorage) delete(w http.ResponseWriter, r *http.Request, bucket, name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	obj, ok := f.lookup(w, r, bucket, name)
+	if !ok || !f.preconditionsMet(w, r, bucket, name) {
+		return
+	}
+	if obj.temporaryHold || obj.eventBasedHold {
+		writeError(w, http.StatusForbidden, fmt.Sprintf("Object '%s/%s' is under active hold and cannot be deleted.", bucket, name))
+		return
+	}
+	delete(f.objects, key(bucket, name))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (f *fakeStorage) patch(w http.ResponseWriter, r *http.Request, bucket, name string) {
+	var attrs map[string]json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&attrs); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	obj, ok := f.lookup(w, r, bucket, name)
+	if !ok {
+		return
+	}
+	if v, ok := attrs["temporaryHold"]; ok {
+		json.Unmarshal(v, &obj.temporaryHold)
+	}
+	if v, ok := attrs["eventBasedHold"]; ok {
+		json.Unmarshal(v, &obj.eventBasedHold)
+	}
+	if v, ok := attrs["metadata"]; ok {
+		json.Unmarshal(v, &obj.metadata)
+	}
+	obj.metageneration++
+	writeJSON(w, http.StatusOK, obj.resource())
+}
+
+func (f *fakeStorage) compose(w http.ResponseWriter, r *http.Request, bucket, name string) {
+	var req struct {
+		Destination   fakeAttrs `json:"destination"`
+		SourceObjects []struct {
+			Name string `json:"name"`
+		} `json:"sourceObjects"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	f.mu.Lock()
+	var data []byte
+	for _, src := range req.SourceObjects {
+		obj, ok := f.objects[key(bucket, src.Name)]
+		if !ok {
+			f.mu.Unlock()
+			writeError(w, http.StatusNotFound, fmt.Sprintf("No such object: %s/%s", bucket, src.Name))
+			return
+		}
+		data = append(data, obj.data...)
+	}
+	if !f.preconditionsMet(w, r, bucket, name) {
+		f.mu.Unlock()
+		return
+	}
+	// compose does not keep the attributes of the sources
+	obj := f.store(bucket, name, data, req.Destination)
+	resource := obj.resource()
+	f.mu.Unlock()
+
+	f.notify(bucket, name)
+	writeJSON(w, http.StatusOK, resource)
+}
+
+func (f *fakeStorage) rewrite(w http.ResponseWriter, r *http.Request, srcBucket, srcName, dstBucket, dstName string) {
+	var attrs fakeAttrs
+	if err := json.NewDecoder(r.Body).Decode(&attrs); err != nil && err != io.EOF {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	f.mu.Lock()
+	src, ok := f.objects[key(srcBucket, srcName)]
+	if gen := r.URL.Query().Get("sourceGeneration"); ok && gen != "" && gen != strconv.FormatInt(src.generation, 10) {
+		ok = false
+	}
+	if !ok {
+		f.mu.Unlock()
+		writeError(w, http.StatusNotFound, fmt.Sprintf("No such object: %s/%s", srcBucket, srcName))
+		return
+	}
+	if !f.preconditionsMet(w, r, dstBucket, dstName) {
+		f.mu.Unlock()
+		return
+	}
+	// attributes of the request replace those of the source
+	merged := fakeAttrs{
+		ContentType:     src.contentType,
+		ContentEncoding: src.contentEncoding,
+		Metadata:        src.metadata,
+		StorageClass:    attrs.StorageClass,
+		CustomTime:      attrs.CustomTime,
+		TemporaryHold:   attrs.TemporaryHold,
+		EventBasedHold:  attrs.EventBasedHold,
+	}
+	if attrs.ContentType != "" {
+		merged.ContentType = attrs.ContentType
+	}
+	if attrs.ContentEncoding != "" {
+		merged.ContentEncoding = attrs.ContentEncoding
+	}
+	if attrs.Metadata != nil {
+		merged.Metadata = attrs.Metadata
+	}
+	obj := f.store(dstBucket, dstName, src.data, merged)
+	resource := obj.resource()
+	f.mu.Unlock()
+
+	f.notify(dstBucket, dstName)
+	writeJSON(w, http.StatusOK, map[string]any{
+		"kind":                "storage#rewriteResponse",
+		"done":                true,
+		"objectSize":          strconv.Itoa(len(src.data)),
+		"totalBytesRewritten": strconv.Itoa(len(src.data)),
+		"resource":            resource,
+	})
+}
+
+func (f *fakeStorage) list(w http.ResponseWriter, r *http.Request, bucket string) {
+	prefix := r.URL.Query().Get("prefix")
+
+	f.mu.Lock()
+	var items []map[string]any
+	for _, name := range f.namesLocked(bucket) {
+		if strings.HasPrefix(name, prefix) {
+			items = append(items, f.objects[key(bucket, name)].resource())
+		}
+	}
+	f.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]any{"kind": "storage#objects", "items": items})
+}
+
+// namesLocked needs f.mu to be held
+func (f *fakeStorage) namesLocked(bucket string) []string {
+	var names []string
+	for _, obj := range f.objects {
+		if obj.bucket == bucket {
+			names = append(names, obj.name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// resource returns the JSON object resource
+func (o *fakeObject) resource() map[string]any {
+	res := map[string]any{
+		"kind":            "storage#object",
+		"bucket":          o.bucket,
+		"name":            o.name,
+		"generation":      strconv.FormatInt(o.generation, 10),
+		"metageneration":  strconv.FormatInt(o.metageneration, 10),
+		"size":            strconv.Itoa(len(o.data)),
+		"contentType":     o.contentType,
+		"contentEncoding": o.contentEncoding,
+		"storageClass":    o.storageClass,
+		"metadata":        o.metadata,
+		"timeCreated":     o.created.UTC().Format(time.RFC3339Nano),
+		"updated":         o.created.UTC().Format(time.RFC3339Nano),
+		"temporaryHold":   o.temporaryHold,
+		"eventBasedHold":  o.eventBasedHold,
+	}
+	if !o.customTime.IsZero() {
+		res["customTime"] = o.customTime.UTC().Format(time.RFC3339Nano)
+	}
+	return res
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, message string) {
+	writeJSON(w, code, map[string]any{
+		"error": map[string]any{
+			"code":    code,
+			"message": message,
+			"errors":  []map[string]string{{"message": message}},
+		},
+	})
+}
+
+// newTestWorkflow returns a workflow from src to dst of the fake with the default level
+func newTestWorkflow(t testing.TB, srcBucket, src, dstBucket, dst string, options Options) *Workflow {
+	t.Helper()
+	wf, err := NewWorkflow(context.Background(), gzip.DefaultCompression, srcBucket, src, dstBucket, dst, options)
+	if err != nil {
+		t.Fatalf("NewWorkflow: %v", err)
+	}
+	t.Cleanup(wf.Close)
+	return wf
+}
+
+// gunzip returns the decompressed data or fails the test
+func gunzip(t testing.TB, data []byte) []byte {
+	t.Helper()
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("gzip.NewReader: %v", err)
+	}
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("reading gzip stream: %v", err)
+	}
+	return out
+}
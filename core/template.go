@@ -0,0 +1,58 @@
+package core
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var placeholderPattern = regexp.MustCompile(`\{[^}]*\}`)
+
+// templatePlaceholders are the placeholders supported by ExpandTemplate
+var templatePlaceholders = []string{"{object}", "{dir}", "{name}", "{ext}", "{date}"}
+
+// ValidateTemplate returns an error if the template contains unknown placeholders
+func ValidateTemplate(template string) error {
+	for _, placeholder := range placeholderPattern.FindAllString(template, -1) {
+		known := false
+		for _, p := range templatePlaceholders {
+			known = known || p == placeholder
+		}
+		if !known {
+			return fmt.Errorf("unknown placeholder %s, supported are %s", placeholder, strings.Join(templatePlaceholders, ", "))
+		}
+	}
+	return nil
+}
+
+// ExpandTemplate derives an object name from the source object name. Supported
+// placeholders are {object} (full name), {dir} (directory without trailing slash),
+// {name} (base name), {ext} (extension without dot) and {date} (date of t, YYYY-MM-DD). With
+// a zero t {date} is kept, e.g. for the workflow to expand it once the source is opened
+func ExpandTemplate(template, objectName string, t time.Time) string {
+	dir, name := path.Split(objectName)
+	dir = strings.TrimSuffix(dir, "/")
+	if dir == "" {
+		// avoid a leading or double slash for objects at the root of the bucket
+		template = strings.ReplaceAll(template, "{dir}/", "")
+	}
+
+	date := "{date}"
+	if !t.IsZero() {
+		date = t.UTC().Format(time.DateOnly)
+	}
+	return strings.NewReplacer(
+		"{object}", objectName,
+		"{dir}", dir,
+		"{name}", name,
+		"{ext}", strings.TrimPrefix(path.Ext(name), "."),
+		"{date}", date,
+	).Replace(template)
+}
+
+// DatePartition returns the Hive-style partition prefix of the date of t, e.g. year=2024/month=01/day=31/
+func DatePartition(t time.Time) string {
+	return t.UTC().Format("year=2006/month=01/day=02/")
+}
@@ -0,0 +1,44 @@
+package core
+
+import (
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer uses the global tracer provider, which is a no-op unless an exporter is configured
+var tracer = otel.Tracer("github.com/mrbuk/gcs-compressor/core")
+
+func objectAttributes(src, dst objectNamer) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("gcs.source.bucket", src.BucketName()),
+		attribute.String("gcs.source.object", src.ObjectName()),
+		attribute.String("gcs.destination.bucket", dst.BucketName()),
+		attribute.String("gcs.destination.object", dst.ObjectName()),
+	}
+}
+
+type objectNamer interface {
+	BucketName() string
+	ObjectName() string
+}
+
+func resultAttributes(result Result) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.Int64("compression.bytes_in", result.BytesIn),
+		attribute.Int64("compression.bytes_out", result.BytesOut),
+		attribute.Float64("compression.ratio", result.Ratio),
+		attribute.String("compression.codec", result.Codec),
+		attribute.String("compression.copy_reason", result.CopyReason),
+	}
+}
+
+// endSpan records the error, if any, and ends the span
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
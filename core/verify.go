@@ -0,0 +1,68 @@
+package core
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+)
+
+// ErrChecksumMismatch is returned by VerifyDecompressed when the decompressed content of
+// the destination object does not match the stored checksums of the source
+var ErrChecksumMismatch = errors.New("decompressed content does not match source checksum")
+
+// VerifyDecompressed reads the destination object as stored, decompresses it and compares
+// its checksums with the ones stored via Options.StoreSourceChecksums
+func (c *Workflow) VerifyDecompressed(ctx context.Context) error {
+	attrs, err := c.dstObject.Attrs(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot read destination object metadata: %w", err)
+	}
+
+	wantCRC32C, ok := attrs.Metadata[SourceCRC32CMetadataKey]
+	if !ok {
+		return fmt.Errorf("destination object has no %s metadata", SourceCRC32CMetadataKey)
+	}
+	wantMD5 := attrs.Metadata[SourceMD5MetadataKey]
+
+	codecName := attrs.Metadata[CodecMetadataKey]
+	if codecName == "" {
+		codecName = attrs.ContentEncoding
+	}
+	codec, ok := LookupCodec(codecName)
+	if !ok {
+		return fmt.Errorf("destination object has unknown codec '%s'", codecName)
+	}
+
+	dstReader, err := c.dstObject.ReadCompressed(true).NewReader(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to open destination object: %w", err)
+	}
+	defer dstReader.Close()
+
+	codecReader, err := codec.NewReader(&contextReader{ctx: ctx, r: dstReader})
+	if err != nil {
+		return fmt.Errorf("destination object is not %s compressed: %w", codec.Name, err)
+	}
+	defer codecReader.Close()
+
+	crc := crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	md5Hash := md5.New()
+	if _, err := io.Copy(io.MultiWriter(crc, md5Hash), codecReader); err != nil {
+		return fmt.Errorf("failed to decompress destination object: %w", err)
+	}
+
+	if got := encodeCRC32C(crc.Sum32()); got != wantCRC32C {
+		return fmt.Errorf("%w: crc32c is %s, expected %s", ErrChecksumMismatch, got, wantCRC32C)
+	}
+	if got := base64.StdEncoding.EncodeToString(md5Hash.Sum(nil)); wantMD5 != "" && got != wantMD5 {
+		return fmt.Errorf("%w: md5 is %s, expected %s", ErrChecksumMismatch, got, wantMD5)
+	}
+
+	log.Printf("%s - '%s' verified decompressed content of '%s/%s'", GetWorkerName(ctx), c.srcObject.ObjectName(), c.dstObject.BucketName(), c.dstObject.ObjectName())
+	return nil
+}
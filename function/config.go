@@ -0,0 +1,130 @@
+package function
+
+import (
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	workflow "github.com/mrbuk/gcs-compressor/core"
+)
+
+// config is read from environment variables at cold start
+type config struct {
+	DestinationBucket string
+	CompressionLevel  int
+	// IgnorePatterns are substrings of object names that are not compressed
+	IgnorePatterns    []string
+	IncludeExtensions []string
+	DestinationSuffix string
+	DeleteSource      bool
+	// FailIfExists reports existing destination objects as errors instead of
+	// treating them as already compressed by a previous invocation
+	FailIfExists bool
+	// SignURLs adds a signed download URL of the destination object to the response
+	SignURLs         bool
+	SignedURLExpires time.Duration
+	// SkipStatusCode answers skipped events and already compressed objects, 200 or 204
+	SkipStatusCode int
+}
+
+// loadConfig reads the configuration from environment variables. Unset variables
+// default to the previous fixed behavior
+func loadConfig() (config, error) {
+	cfg := config{
+		DestinationBucket: os.Getenv("DESTINATION_BUCKET"),
+		CompressionLevel:  gzip.BestSpeed,
+		IgnorePatterns:    []string{"dax-tmp"},
+		IncludeExtensions: workflow.ParseList(os.Getenv("INCLUDE_EXTENSIONS")),
+		DestinationSuffix: os.Getenv("DESTINATION_SUFFIX"),
+		DeleteSource:      true,
+		SignedURLExpires:  time.Hour,
+		SkipStatusCode:    http.StatusOK,
+	}
+
+	if cfg.DestinationBucket == "" {
+		return cfg, fmt.Errorf("provide DESTINATION_BUCKET env variable")
+	}
+
+	if v := os.Getenv("COMPRESSION_LEVEL"); v != "" {
+		level, err := strconv.Atoi(v)
+		if err != nil {
+			return cfg, fmt.Errorf("COMPRESSION_LEVEL '%s' is not a number", v)
+		}
+		codec, _ := workflow.LookupCodec("gzip")
+		if !codec.ValidLevel(level) {
+			return cfg, fmt.Errorf("COMPRESSION_LEVEL %d is not supported, use levels from %d to %d", level, codec.MinLevel, codec.MaxLevel)
+		}
+		cfg.CompressionLevel = level
+	}
+
+	if v, ok := os.LookupEnv("IGNORE_PATTERNS"); ok {
+		cfg.IgnorePatterns = workflow.ParseList(v)
+	}
+
+	if v := os.Getenv("DELETE_SOURCE"); v != "" {
+		deleteSource, err := strconv.ParseBool(v)
+		if err != nil {
+			return cfg, fmt.Errorf("DELETE_SOURCE '%s' is not a boolean", v)
+		}
+		cfg.DeleteSource = deleteSource
+	}
+
+	if v := os.Getenv("FAIL_IF_EXISTS"); v != "" {
+		failIfExists, err := strconv.ParseBool(v)
+		if err != nil {
+			return cfg, fmt.Errorf("FAIL_IF_EXISTS '%s' is not a boolean", v)
+		}
+		cfg.FailIfExists = failIfExists
+	}
+
+	if v := os.Getenv("SIGN_URLS"); v != "" {
+		signURLs, err := strconv.ParseBool(v)
+		if err != nil {
+			return cfg, fmt.Errorf("SIGN_URLS '%s' is not a boolean", v)
+		}
+		cfg.SignURLs = signURLs
+	}
+
+	if v := os.Getenv("SIGNED_URL_EXPIRES"); v != "" {
+		expires, err := time.ParseDuration(v)
+		if err != nil || expires <= 0 || expires > 7*24*time.Hour {
+			return cfg, fmt.Errorf("SIGNED_URL_EXPIRES '%s' must be a duration of up to 7 days", v)
+		}
+		cfg.SignedURLExpires = expires
+	}
+
+	if v := os.Getenv("SKIP_STATUS_CODE"); v != "" {
+		code, err := strconv.Atoi(v)
+		if err != nil || (code != http.StatusOK && code != http.StatusNoContent) {
+			return cfg, fmt.Errorf("SKIP_STATUS_CODE '%s' must be 200 or 204", v)
+		}
+		cfg.SkipStatusCode = code
+	}
+
+	return cfg, nil
+}
+
+// ignored reports whether the object name contains one of the ignore patterns
+func (c config) ignored(objectName string) bool {
+	for _, pattern := range c.IgnorePatterns {
+		if strings.Contains(objectName, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// configError returns the cold start configuration error as an HttpError, if any
+func configError() *HttpError {
+	if cfgErr == nil {
+		return nil
+	}
+	return &HttpError{
+		Message: cfgErr.Error(),
+		Code:    http.StatusInternalServerError,
+	}
+}
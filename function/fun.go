@@ -1,13 +1,12 @@
 package function
 
 import (
-	"compress/gzip"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
-	"os"
 	"strings"
 
 	"github.com/GoogleCloudPlatform/functions-framework-go/functions"
@@ -26,57 +25,126 @@ type HttpError struct {
 	Code    int
 }
 
+// Response is the JSON body returned by the function
+type Response struct {
+	Status   string  `json:"status"`
+	Object   string  `json:"object"`
+	BytesIn  int64   `json:"bytesIn"`
+	BytesOut int64   `json:"bytesOut"`
+	Ratio    float64 `json:"ratio"`
+	Error    string  `json:"error,omitempty"`
+	// SignedURL is a time-limited download URL of the destination object, if enabled
+	SignedURL string `json:"signedUrl,omitempty"`
+}
+
+// values of Response.Status
+const (
+	StatusCompressed = "compressed"
+	StatusSkipped    = "skipped"
+	// StatusAlreadyCompressed is returned for retried events of an object whose destination exists
+	StatusAlreadyCompressed = "already_compressed"
+	StatusError             = "error"
+)
+
+var (
+	cfg    config
+	cfgErr error
+)
+
 func init() {
 	functions.HTTP("compress", Compress)
+
+	cfg, cfgErr = loadConfig()
+	if cfgErr != nil {
+		log.Printf("error: invalid configuration: %v", cfgErr)
+		return
+	}
+	log.Printf("configuration: destinationBucket=%s compressionLevel=%d ignorePatterns=%v includeExtensions=%v destinationSuffix='%s' deleteSource=%t failIfExists=%t signURLs=%t",
+		cfg.DestinationBucket, cfg.CompressionLevel, cfg.IgnorePatterns, cfg.IncludeExtensions, cfg.DestinationSuffix, cfg.DeleteSource, cfg.FailIfExists, cfg.SignURLs)
 }
 
 // Compress is an HTTP Cloud Function with a request parameter.
 func Compress(w http.ResponseWriter, r *http.Request) {
-	compressionLevel := gzip.BestSpeed
-	destinationBucketName := os.Getenv("DESTINATION_BUCKET")
-
-	if destinationBucketName == "" {
-		handleError(w, &HttpError{
-			Message: "provide DESTINATION_BUCKET env variable",
-			Code:    http.StatusInternalServerError,
-		})
+	if httpErr := configError(); httpErr != nil {
+		handleError(w, "", httpErr)
 		return
 	}
 
 	event, httpErr := decodeData(r)
 	if httpErr != nil {
-		handleError(w, httpErr)
+		handleError(w, "", httpErr)
 		return
 	}
+	event.Name = workflow.NormalizeObjectName(event.Name)
 
-	// ingore files containing 'dax-tmp'
-	if event.Name == "" || strings.Contains(event.Name, "dax-tmp") {
+	// ingore files matching the ignore patterns, by default containing 'dax-tmp'
+	if event.Name == "" || cfg.ignored(event.Name) {
 		log.Printf("ignoring event for temp object: '%s'\n", event.Name)
+		writeSkipped(w, Response{Status: StatusSkipped, Object: event.Name})
+		return
+	}
+
+	// ignore already compressed objects written to the source bucket
+	if cfg.DestinationSuffix != "" && event.Bucket == cfg.DestinationBucket && strings.HasSuffix(event.Name, cfg.DestinationSuffix) {
+		log.Printf("ignoring event for compressed object: '%s'\n", event.Name)
+		writeSkipped(w, Response{Status: StatusSkipped, Object: event.Name})
+		return
+	}
+
+	// ignore files with extensions not included, e.g. already compressed formats
+	if !workflow.HasExtension(event.Name, cfg.IncludeExtensions) {
+		log.Printf("ignoring event for object with excluded extension: '%s'\n", event.Name)
+		writeSkipped(w, Response{Status: StatusSkipped, Object: event.Name})
 		return
 	}
 
 	// compress all other files
 	ctx := context.Background()
-	wf, err := workflow.NewWorkflow(ctx, compressionLevel, event.Bucket, event.Name, destinationBucketName, event.Name)
+	wf, err := workflow.NewWorkflow(ctx, cfg.CompressionLevel, event.Bucket, event.Name, cfg.DestinationBucket, event.Name+cfg.DestinationSuffix, workflow.Options{})
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		handleError(w, event.Name, &HttpError{err.Error(), http.StatusInternalServerError})
 		return
 	}
 	defer wf.Close()
 
-	err = wf.Compress(ctx)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	result, err := wf.Compress(ctx)
+	if errors.Is(err, workflow.ErrObjectTooSmall) || errors.Is(err, workflow.ErrObjectEmpty) || errors.Is(err, workflow.ErrSourceGone) {
+		log.Printf("skipping '%s': %v", event.Name, err)
+		writeSkipped(w, Response{Status: StatusSkipped, Object: event.Name})
+		return
+	}
+	if errors.Is(err, workflow.ErrDestinationExists) && !cfg.FailIfExists {
+		log.Printf("destination of '%s' exists already, assuming a retried event", event.Name)
+		writeSkipped(w, Response{Status: StatusAlreadyCompressed, Object: event.Name})
 		return
 	}
-
-	err = wf.Delete(ctx)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		handleError(w, event.Name, &HttpError{err.Error(), http.StatusInternalServerError})
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
+	if cfg.DeleteSource {
+		err = wf.Delete(ctx)
+		if err != nil {
+			handleError(w, event.Name, &HttpError{err.Error(), http.StatusInternalServerError})
+			return
+		}
+	}
+
+	response := Response{
+		Status:   StatusCompressed,
+		Object:   event.Name,
+		BytesIn:  result.BytesIn,
+		BytesOut: result.BytesOut,
+		Ratio:    result.Ratio,
+	}
+	if cfg.SignURLs {
+		if response.SignedURL, err = wf.SignedURL(ctx, cfg.SignedURLExpires); err != nil {
+			handleError(w, event.Name, &HttpError{err.Error(), http.StatusInternalServerError})
+			return
+		}
+	}
+	writeResponse(w, http.StatusOK, response)
 }
 
 func decodeData(r *http.Request) (CloudStorageEvent, *HttpError) {
@@ -87,7 +155,25 @@ func decodeData(r *http.Request) (CloudStorageEvent, *HttpError) {
 	return event, nil
 }
 
-func handleError(w http.ResponseWriter, err *HttpError) {
+func handleError(w http.ResponseWriter, object string, err *HttpError) {
 	log.Printf("error: %s", err.Message)
-	http.Error(w, err.Message, err.Code)
+	writeResponse(w, err.Code, Response{Status: StatusError, Object: object, Error: err.Message})
+}
+
+// writeSkipped answers events that are not processed with SKIP_STATUS_CODE, by default 200
+// with the response body. A 204 has no body. Both keep Eventarc from retrying the event
+func writeSkipped(w http.ResponseWriter, response Response) {
+	if cfg.SkipStatusCode == http.StatusNoContent {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeResponse(w, http.StatusOK, response)
+}
+
+func writeResponse(w http.ResponseWriter, code int, response Response) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("error writing response: %v", err)
+	}
 }
@@ -1,199 +1,1210 @@
 package main
 
 import (
-	"compress/gzip"
+	"bufio"
 	"context"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/signal"
+	"path"
+	"regexp"
 	"runtime"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/storage"
 	"github.com/mrbuk/gcs-compressor/core"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/time/rate"
+	"google.golang.org/api/impersonate"
+	"google.golang.org/api/option"
 )
 
 var (
-	compressionLevel      int
-	sourceBucketName      string
-	sourceObjectName      string
-	destinationBucketName string
-	destinationObjectName string
-	subscriptionName      string
-	topicName             string
-	projectId             string
-
-	subscription *pubsub.Subscription
-	topic        *pubsub.Topic
+	compressionLevel       int
+	codecName              string
+	setContentEncoding     bool
+	sourceBucketName       string
+	sourcePrefix           string
+	sourceObjectName       string
+	sourceGeneration       int64
+	destinationBucketName  string
+	destinationObjectName  string
+	subscriptionName       string
+	topicName              string
+	projectId              string
+	eventTypes             string
+	minSize                int64
+	maxSize                int64
+	copySmallFiles         bool
+	skipEmpty              bool
+	deadLetterTopicName    string
+	maxRedeliveries        int
+	resultTopicName        string
+	sourceProject          string
+	credentialsFile        string
+	impersonateAccount     string
+	destinationProject     string
+	userProject            string
+	listCodecs             bool
+	printVersion           bool
+	gzipBufferSize         int
+	storeOriginalSize      bool
+	storeSourceChecksums   bool
+	tagProducer            bool
+	deleteOnInflation      bool
+	computeRatio           bool
+	destinationSuffix      string
+	destinationTemplate    string
+	partitionByDate        bool
+	overwrite              bool
+	onExisting             string
+	ignoredEventAction     string
+	statusAddr             string
+	statusToken            string
+	appendDestination      bool
+	inPlace                bool
+	includeNoncurrent      bool
+	metadataRoutes         string
+	routes                 []core.MetadataRoute
+	modifiedAfter          string
+	reportFile             string
+	otlpEndpoint           string
+	includeExtensions      string
+	chunkSize              int
+	parallelChunks         int
+	downloadParallelism    int
+	copyExtensions         string
+	compressContentTypes   string
+	levelBySize            string
+	sizeLevels             []core.SizeLevel
+	skipContentTypes       string
+	destinationContentType string
+	kmsKey                 string
+	destinationACL         string
+	storageClass           string
+	maxObjectsPerSecond    float64
+	ackAfterProcessing     bool
+	maxOutstandingMessages int
+	maxExtension           time.Duration
+	localInput             string
+	localOutput            string
+	sourceGlob             string
+	objectList             string
+	continueOnError        bool
+	logFile                string
+	gzipHeaderName         string
+	gzipHeaderComment      string
+	deterministic          bool
+	workflowRetries        int
+	minRatio               float64
+	allowEmpty             bool
+	manifestName           string
+	replicaBuckets         []string
+	bucketMapping          = make(map[string]string)
+	notFoundRetries        int
+	notFoundDelay          time.Duration
+	temporaryHold          bool
+	eventBasedHold         bool
+	passthroughEncoded     bool
+	preserveCustomTime     bool
+	perObjectTimeout       time.Duration
+	probeDestination       bool
+
+	allowedEventTypes map[string]bool
+	modifiedAfterTime time.Time
+	extensions        []string
+	codec             core.Codec
+
+	subscription    *pubsub.Subscription
+	topic           *pubsub.Topic
+	deadLetterTopic *pubsub.Topic
+	resultTopic     *pubsub.Topic
+
+	// limiter throttles the start of jobs, nil if unlimited
+	limiter *rate.Limiter
 
 	mainCtx    context.Context
 	mainCancel context.CancelFunc
+
+	// jobs are tracked from being enqueued until finished to drain them on shutdown
+	jobsMu          sync.Mutex
+	jobsWg          sync.WaitGroup
+	draining        bool
+	drainedJobs     atomic.Int64
+	republishedJobs atomic.Int64
+	lostJobs        atomic.Int64
+
+	shutdownGracePeriod time.Duration
+	republishTimeout    time.Duration
+
+	// paused stops enqueuing new jobs while in-flight jobs finish
+	paused atomic.Bool
 )
 
 const WORKFLOW_TIMEOUT = 60 * time.Minute
 
+// credentialOptions authenticate the storage and pubsub clients. Empty uses ADC
+var credentialOptions []option.ClientOption
+
+var kmsKeyPattern = regexp.MustCompile(`^projects/[^/]+/locations/[^/]+/keyRings/[^/]+/cryptoKeys/[^/]+$`)
+
+// predefined ACLs supported by GCS for new objects
+var predefinedACLs = []string{"authenticatedRead", "bucketOwnerFullControl", "bucketOwnerRead", "private", "projectPrivate", "publicRead"}
+
+// storage classes of new objects
+var storageClasses = []string{"STANDARD", "NEARLINE", "COLDLINE", "ARCHIVE"}
+
+const (
+	// message attributes used to back off republished messages
+	REDELIVERY_COUNT_ATTRIBUTE = "redeliveryCount"
+	NOT_BEFORE_ATTRIBUTE       = "notBefore"
+	// message attribute containing the publish time of the message originally received,
+	// which is kept when the message is republished
+	ORIGINAL_PUBLISH_TIME_ATTRIBUTE = "originalPublishTime"
+	// message attribute containing the failure reason of dead-lettered messages
+	ERROR_ATTRIBUTE = "error"
+	// message attribute containing the id of jobs enqueued via /compress
+	JOB_ID_ATTRIBUTE = "jobId"
+
+	// initial delay between in-process retries of -workflowRetries, doubled per retry
+	WORKFLOW_RETRY_BASE_DELAY = time.Second
+
+	// interval held messages check whether processing was resumed
+	PAUSE_POLL_INTERVAL = time.Second
+
+	// values of -ignoredEventAction
+	IGNORED_EVENT_ACK  = "ack"
+	IGNORED_EVENT_NACK = "nack"
+
+	REDELIVERY_BASE_DELAY = 10 * time.Second
+	REDELIVERY_MAX_DELAY  = 10 * time.Minute
+	// longest wait for notBefore within the receive callback, later messages are nacked
+	NOT_BEFORE_MAX_WAIT = 5 * time.Second
+)
+
 func init() {
-	flag.IntVar(&compressionLevel, "compressionLevel", gzip.DefaultCompression, "NoCompression = 0, BestSpeed = 1, BestCompression = 9, DefaultCompression = -1, HuffmanOnly = -2")
-	flag.StringVar(&sourceBucketName, "sourceBucket", "", "name of bucket to read from: e.g. gcs-source-bucket [required]")
-	flag.StringVar(&destinationBucketName, "destinationBucket", "", "name of bucket to write to: e.g. gcs-destination bucket [required]")
+	// the flat flag set of all flags is kept for compatibility with invocations without command
+	for _, register := range flagGroups {
+		register(flag.CommandLine)
+	}
+	flag.BoolVar(&listCodecs, "listCodecs", false, "print the supported codecs and their content encoding and exit")
+	flag.BoolVar(&printVersion, "version", false, "print the version and exit")
+	flag.Usage = usage
+}
+
+func validateFlags() {
+	// local files are compressed without accessing GCS
+	local := localInput != "" || localOutput != ""
+	if local && (localInput == "" || localOutput == "" || (mode != "" && mode != "compress")) {
+		fmt.Fprintf(flag.CommandLine.Output(), "error:	-localInput and -localOutput need to be provided together and only for compress\n\n")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	if local {
+		mode = "local"
+	}
+
+	// source=destination entries map source buckets to destination buckets. Of the other
+	// entries the first is the destination of all other source buckets, further ones receive
+	// replicas of the objects written to it
+	var buckets []string
+	for _, entry := range core.ParseList(destinationBucketName) {
+		if src, dst, ok := strings.Cut(entry, "="); ok {
+			bucketMapping[src] = dst
+			continue
+		}
+		buckets = append(buckets, entry)
+	}
+	destinationBucketName = ""
+	if len(buckets) > 0 {
+		destinationBucketName, replicaBuckets = buckets[0], buckets[1:]
+	}
+
+	// check for required values
+	if !local && (sourceBucketName == "" || destinationBucketName == "") && len(bucketMapping) == 0 {
+		fmt.Fprintf(flag.CommandLine.Output(), "error:	-sourceBucket and -destinationBucket are required\n\n")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	// without command ensure that only one of sourceObjectName, sourcePrefix or subscription
+	// is set. In combination with subscription, sourcePrefix filters the events instead
+	if mode == "" {
+		switch {
+		case sourceObjectName != "" && sourcePrefix == "" && subscriptionName == "":
+			mode = "compress"
+		case sourcePrefix != "" && sourceObjectName == "" && subscriptionName == "":
+			mode = "archive"
+		case sourceGlob != "" && sourceObjectName == "" && subscriptionName == "":
+			mode = "bulk"
+		case objectList != "" && sourceObjectName == "" && subscriptionName == "":
+			mode = "bulk"
+		case subscriptionName != "" && sourceObjectName == "":
+			mode = "serve"
+		default:
+			fmt.Fprintf(flag.CommandLine.Output(), "error:	provide either -sourceObjectName for cli xor -sourcePrefix for archive xor -sourceGlob or -objectList for bulk xor -subscription\n\n")
+			flag.Usage()
+			os.Exit(1)
+		}
+	}
+
+	if (mode == "compress" || mode == "decompress") && sourceObjectName == "" {
+		fmt.Fprintf(flag.CommandLine.Output(), "error:	-sourceObjectName needs to be provided\n\n")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	if mode == "serve" && subscriptionName == "" {
+		fmt.Fprintf(flag.CommandLine.Output(), "error:	-subscription needs to be provided\n\n")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	if perObjectTimeout < 0 || (perObjectTimeout > 0 && mode != "bulk") {
+		fmt.Fprintf(flag.CommandLine.Output(), "error:	-perObjectTimeout cannot be negative and is only supported for bulk\n\n")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	// -overwrite is kept as alias of -onExisting overwrite
+	if overwrite {
+		onExisting = string(core.OnExistingOverwrite)
+	}
+	if !slices.Contains(core.ExistingPolicies, core.ExistingPolicy(onExisting)) {
+		fmt.Fprintf(flag.CommandLine.Output(), "error:	-onExisting needs to be one of %v\n\n", core.ExistingPolicies)
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	if len(bucketMapping) > 0 && mode != "serve" {
+		fmt.Fprintf(flag.CommandLine.Output(), "error:	-destinationBucket mappings source=destination are only supported for serve\n\n")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	for src, dst := range bucketMapping {
+		if src == "" || dst == "" || (src == dst && destinationSuffix == "") || slices.Contains(replicaBuckets, src) {
+			fmt.Fprintf(flag.CommandLine.Output(), "error:	-destinationBucket mapping '%s=%s' is invalid: both buckets are required, the same bucket requires -destinationSuffix\n\n", src, dst)
+			flag.PrintDefaults()
+			os.Exit(1)
+		}
+	}
+
+	// key=value:bucket entries route objects by their custom metadata
+	for _, entry := range core.ParseList(metadataRoutes) {
+		match, bucket, _ := cutLast(entry, ":")
+		key, value, ok := strings.Cut(match, "=")
+		if !ok || key == "" || bucket == "" || (mode != "compress" && mode != "bulk" && mode != "serve") {
+			fmt.Fprintf(flag.CommandLine.Output(), "error:	-metadataRoutes entry '%s' is invalid: entries are key=value:bucket and only supported for compress, bulk and serve\n\n", entry)
+			flag.PrintDefaults()
+			os.Exit(1)
+		}
+		routes = append(routes, core.MetadataRoute{Key: key, Value: value, Bucket: bucket})
+	}
+
+	if len(replicaBuckets) > 0 && (slices.Contains(replicaBuckets, sourceBucketName) || (mode != "compress" && mode != "bulk" && mode != "serve")) {
+		fmt.Fprintf(flag.CommandLine.Output(), "error:	multiple -destinationBucket are only supported for compress, bulk and serve and only the first may be the source bucket\n\n")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	if includeNoncurrent && (mode != "bulk" || sourceGlob != "" || objectList != "") {
+		fmt.Fprintf(flag.CommandLine.Output(), "error:	-includeNoncurrent is only supported for bulk listing -sourcePrefix, not with -sourceGlob or -objectList\n\n")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	// a held destination cannot be replaced by the next append
+	if appendDestination && (len(replicaBuckets) > 0 || parallelChunks > 1 || minRatio > 0 || storeOriginalSize || storeSourceChecksums || temporaryHold || eventBasedHold) {
+		fmt.Fprintf(flag.CommandLine.Output(), "error:	-append cannot be combined with replicas, -parallelChunks, -minRatio, -storeOriginalSize, -storeSourceChecksums, -temporaryHold or -eventBasedHold\n\n")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	if inPlace && ((mode != "compress" && mode != "bulk" && mode != "serve") || sourceBucketName != destinationBucketName || destinationSuffix != "" || destinationTemplate != "" || partitionByDate || metadataRoutes != "" || len(bucketMapping) > 0) {
+		fmt.Fprintf(flag.CommandLine.Output(), "error:	-inPlace requires the same -sourceBucket and -destinationBucket and cannot be combined with -destinationSuffix, -destinationTemplate, -partitionByDate, -metadataRoutes or bucket mappings\n\n")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	if inPlace && (len(replicaBuckets) > 0 || appendDestination || parallelChunks > 1 || !setContentEncoding || !passthroughEncoded) {
+		fmt.Fprintf(flag.CommandLine.Output(), "error:	-inPlace cannot be combined with replicas, -append, -parallelChunks, -setContentEncoding=false or -passthroughEncoded=false\n\n")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	if minRatio < 0 || (minRatio > 0 && !computeRatio) {
+		fmt.Fprintf(flag.CommandLine.Output(), "error:	-minRatio cannot be negative and requires -computeRatio\n\n")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	if workflowRetries < 0 {
+		fmt.Fprintf(flag.CommandLine.Output(), "error:	-workflowRetries cannot be negative\n\n")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	if notFoundRetries < 0 || notFoundDelay < 0 {
+		fmt.Fprintf(flag.CommandLine.Output(), "error:	-notFoundRetries and -notFoundDelay cannot be negative\n\n")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	if manifestName != "" && mode != "bulk" {
+		fmt.Fprintf(flag.CommandLine.Output(), "error:	-manifest is only supported for bulk\n\n")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	if objectList != "" && (mode != "bulk" || sourcePrefix != "" || sourceGlob != "") {
+		fmt.Fprintf(flag.CommandLine.Output(), "error:	-objectList is only supported instead of -sourcePrefix and -sourceGlob for bulk\n\n")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	if sourceGlob != "" {
+		if _, err := path.Match(sourceGlob, ""); err != nil || mode != "bulk" || sourcePrefix != "" {
+			fmt.Fprintf(flag.CommandLine.Output(), "error:	-sourceGlob needs to be a valid pattern, e.g. logs/2024-*/*.json, and is only supported instead of -sourcePrefix for bulk\n\n")
+			flag.PrintDefaults()
+			os.Exit(1)
+		}
+	}
+
+	if mode == "archive" && destinationObjectName == "" {
+		fmt.Fprintf(flag.CommandLine.Output(), "error:	when using -sourcePrefix, -destinationObjectName of the archive needs to be provided\n\n")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	if modifiedAfter != "" {
+		var err error
+		if modifiedAfterTime, err = time.Parse(time.RFC3339, modifiedAfter); err != nil {
+			fmt.Fprintf(flag.CommandLine.Output(), "error:	-modifiedAfter needs to be a RFC3339 timestamp\n\n")
+			flag.PrintDefaults()
+			os.Exit(1)
+		}
+	}
+
+	if sourceGeneration < 0 || (sourceGeneration > 0 && sourceObjectName == "") {
+		fmt.Fprintf(flag.CommandLine.Output(), "error:	-sourceGeneration cannot be negative and requires -sourceObjectName\n\n")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
 
-	flag.StringVar(&sourceObjectName, "sourceObjectName", "", "name of uncompressed source object [cli-driven]")
-	flag.StringVar(&destinationObjectName, "destinationObjectName", "", "name of compressed destination object [cli-driven]")
+	if err := core.ValidateTemplate(gzipHeaderName); err != nil {
+		fmt.Fprintf(flag.CommandLine.Output(), "error:	-gzipHeaderName: %v\n\n", err)
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	if err := core.ValidateTemplate(destinationTemplate); err != nil {
+		fmt.Fprintf(flag.CommandLine.Output(), "error:	-destinationTemplate: %v\n\n", err)
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	var ok bool
+	if codec, ok = core.LookupCodec(codecName); !ok {
+		fmt.Fprintf(flag.CommandLine.Output(), "error:	-codec '%s' is not supported, see -listCodecs\n\n", codecName)
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	// the workflow uses the native level of the codec
+	level, ok := codec.Level(compressionLevel)
+	if !ok {
+		fmt.Fprintf(flag.CommandLine.Output(), "error:	-compressionLevel %d is not supported by codec %s, which accepts levels %s\n\n", compressionLevel, codec.Name, codec.Levels())
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	compressionLevel = level
+
+	var err error
+	if sizeLevels, err = core.ParseLevelBySize(levelBySize); err != nil {
+		fmt.Fprintf(flag.CommandLine.Output(), "error:	-levelBySize: %v\n\n", err)
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	for i, l := range sizeLevels {
+		if sizeLevels[i].Level, ok = codec.Level(l.Level); !ok {
+			fmt.Fprintf(flag.CommandLine.Output(), "error:	-levelBySize level %d is not supported by codec %s, which accepts levels %s\n\n", l.Level, codec.Name, codec.Levels())
+			flag.PrintDefaults()
+			os.Exit(1)
+		}
+	}
+
+	if !codec.Concatenable && (parallelChunks > 1 || appendDestination) {
+		fmt.Fprintf(flag.CommandLine.Output(), "error:	codec %s cannot be concatenated, which -parallelChunks and -append require\n\n", codec.Name)
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	// objects compressed in place are only recognized by their content encoding
+	if inPlace && codec.ContentEncoding == "" {
+		fmt.Fprintf(flag.CommandLine.Output(), "error:	codec %s has no content encoding, which -inPlace requires\n\n", codec.Name)
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	// objects without content encoding are recognized by their extension
+	if codec.ContentEncoding == "" && destinationSuffix == "" {
+		destinationSuffix = codec.Extension
+	}
+
+	if mode == "compress" {
+		if destinationObjectName == "" {
+			destinationObjectName = destinationName(sourceObjectName)
+		} else {
+			destinationObjectName += destinationSuffix
+		}
+	}
+
+	// decompressed objects are named like the source object without the usual .gz suffix
+	if mode == "decompress" && destinationObjectName == "" {
+		destinationObjectName = strings.TrimSuffix(sourceObjectName, ".gz")
+	}
+
+	if err := checkDestinationObject(sourceBucketName, sourceObjectName, destinationBucketName, destinationObjectName, inPlace); err != nil {
+		fmt.Fprintf(flag.CommandLine.Output(), "error:	%v\n\n", err)
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	// with mappings only both global bucket names are empty, each mapping is checked above
+	mappingsOnly := sourceBucketName == "" && len(bucketMapping) > 0
+	if sourceBucketName == destinationBucketName && !mappingsOnly && (mode == "serve" || mode == "bulk") && destinationSuffix == "" && !inPlace {
+		fmt.Fprintf(flag.CommandLine.Output(),
+			"error:	when using the same -sourceBucket and -destinationBucket, -subscription and bulk require -destinationSuffix\n\n")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	if mode == "serve" && topicName == "" {
+		fmt.Fprintf(flag.CommandLine.Output(), "error:	when usign -subscription -topic needs to be provided.\n\n")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	if chunkSize < 0 {
+		fmt.Fprintf(flag.CommandLine.Output(), "error:	-chunkSize cannot be negative\n\n")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	if parallelChunks < 1 || parallelChunks > core.MaxParallelChunks {
+		fmt.Fprintf(flag.CommandLine.Output(), "error:	-parallelChunks must be between 1 and %d\n\n", core.MaxParallelChunks)
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	if downloadParallelism < 1 || (downloadParallelism > 1 && parallelChunks > 1) {
+		fmt.Fprintf(flag.CommandLine.Output(), "error:	-downloadParallelism must be at least 1 and cannot be combined with -parallelChunks\n\n")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	if gzipBufferSize < 0 {
+		fmt.Fprintf(flag.CommandLine.Output(), "error:	-gzipBufferSize cannot be negative\n\n")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	if republishTimeout <= 0 {
+		fmt.Fprintf(flag.CommandLine.Output(), "error:	-republishTimeout needs to be positive\n\n")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	if maxObjectsPerSecond < 0 {
+		fmt.Fprintf(flag.CommandLine.Output(), "error:	-maxObjectsPerSecond cannot be negative\n\n")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	if maxOutstandingMessages < 0 || maxExtension < 0 {
+		fmt.Fprintf(flag.CommandLine.Output(), "error:	-maxOutstandingMessages and -maxExtension cannot be negative\n\n")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	if minSize < 0 {
+		fmt.Fprintf(flag.CommandLine.Output(), "error:	-minSize cannot be negative\n\n")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	if maxSize < 0 || (maxSize > 0 && maxSize < minSize) {
+		fmt.Fprintf(flag.CommandLine.Output(), "error:	-maxSize cannot be negative or smaller than -minSize\n\n")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	if kmsKey != "" && !kmsKeyPattern.MatchString(kmsKey) {
+		fmt.Fprintf(flag.CommandLine.Output(), "error:	-kmsKey needs to be of format projects/<project>/locations/<location>/keyRings/<keyRing>/cryptoKeys/<key>\n\n")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	storageClass = strings.ToUpper(storageClass)
+	if storageClass != "" && !slices.Contains(storageClasses, storageClass) {
+		fmt.Fprintf(flag.CommandLine.Output(), "error:	-destinationStorageClass '%s' is unknown, use one of %s\n\n", storageClass, strings.Join(storageClasses, ", "))
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	if destinationACL != "" && !slices.Contains(predefinedACLs, destinationACL) {
+		fmt.Fprintf(flag.CommandLine.Output(), "error:	-destinationACL '%s' is unknown, use one of %s\n\n", destinationACL, strings.Join(predefinedACLs, ", "))
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	if maxRedeliveries < 0 || (maxRedeliveries > 0 && deadLetterTopicName == "") {
+		fmt.Fprintf(flag.CommandLine.Output(), "error:	-maxRedeliveries cannot be negative and requires -deadLetterTopic\n\n")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	opts, err := credentials(context.Background())
+	if err != nil {
+		fmt.Fprintf(flag.CommandLine.Output(), "error:	invalid credentials: %v\n\n", err)
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	credentialOptions = opts
+
+	extensions = core.ParseList(includeExtensions)
+
+	allowedEventTypes = make(map[string]bool)
+	for _, eventType := range core.ParseList(eventTypes) {
+		allowedEventTypes[eventType] = true
+	}
+	if ignoredEventAction != IGNORED_EVENT_ACK && ignoredEventAction != IGNORED_EVENT_NACK {
+		fmt.Fprintf(flag.CommandLine.Output(), "error:	-ignoredEventAction needs to be one of %s, %s\n\n", IGNORED_EVENT_ACK, IGNORED_EVENT_NACK)
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	if mode == "serve" && len(allowedEventTypes) == 0 {
+		fmt.Fprintf(flag.CommandLine.Output(), "error:	-eventTypes needs to contain at least one event type\n\n")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+}
+
+func main() {
+	// flags are parsed in main rather than init, so tests of this package get their own
+	flag.Parse()
+	if flag.NArg() > 0 {
+		parseCommand(flag.Args())
+	}
+
+	if printVersion {
+		fmt.Println(versionString())
+		return
+	}
+
+	if listCodecs {
+		for _, codec := range core.Codecs() {
+			fmt.Printf("%s\tContent-Encoding: %s\tExtension: %s\tLevels: %s\n", codec.Name, codec.ContentEncoding, codec.Extension, codec.Levels())
+		}
+		return
+	}
+
+	validateFlags()
+
+	// log writes are unbuffered, so nothing is lost on os.Exit or log.Fatal
+	if logFile != "" {
+		f, err := os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			log.Fatalf("error opening log file: %v", err)
+		}
+		defer f.Close()
+		log.SetOutput(io.MultiWriter(os.Stderr, f))
+	}
+
+	// use two different context to allow to cancel workers and giving them
+	// time to cleanup / republish messages that have not been fully processed
+	mainCtx, mainCancel = context.WithCancel(context.Background())
+	workerCtx, workerCancel := context.WithCancel(mainCtx)
+
+	shutdownTracing, err := setupTracing(mainCtx, otlpEndpoint)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer shutdownTracing(context.Background())
+
+	// fail fast on a misconfigured destination instead of with the first object
+	if mode != "local" {
+		for _, bucketName := range destinationBuckets() {
+			if err := core.CheckDestination(mainCtx, bucketName, probeDestination, workflowOptions()); err != nil {
+				log.Fatalf("error: %v", err)
+			}
+		}
+	}
+
+	// single file should be (de)compressed or all objects under a prefix compressed or archived
+	if mode != "serve" {
+		var s *summary
+		switch mode {
+		case "compress":
+			s = compressObject(mainCtx)
+		case "local":
+			s = compressLocal(mainCtx)
+		case "decompress":
+			s = decompressObject(mainCtx)
+		case "bulk":
+			s = bulkObjects(mainCtx)
+		case "archive":
+			s = archiveObjects(mainCtx)
+		}
+
+		s.report(reportFile)
+		if s.Failed > 0 {
+			shutdownTracing(context.Background())
+			os.Exit(1)
+		}
+		return
+	}
+
+	// event driven
+	pubSubClient, err := pubsub.NewClient(workerCtx, projectId, credentialOptions...)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	noOfConcurrentJob := workers()
+
+	if maxObjectsPerSecond > 0 {
+		limiter = rate.NewLimiter(rate.Limit(maxObjectsPerSecond), 1)
+	}
+
+	// create a worker pool to paralellize compression
+	jobs := make(chan core.WorkflowContext, noOfConcurrentJob)
+	for w := 1; w <= noOfConcurrentJob; w++ {
+		go worker(workerCtx, w, jobs)
+	}
+
+	if statusAddr != "" {
+		go serveAdmin(mainCtx, statusAddr, statusToken, jobs)
+	}
+
+	log.Printf("topic used for republishing '%s'", topicName)
+	topic = pubSubClient.Topic(topicName)
+
+	if deadLetterTopicName != "" {
+		log.Printf("topic used for dead-lettering '%s'", deadLetterTopicName)
+		deadLetterTopic = pubSubClient.Topic(deadLetterTopicName)
+	}
+
+	if resultTopicName != "" {
+		log.Printf("topic used for results '%s'", resultTopicName)
+		resultTopic = pubSubClient.Topic(resultTopicName)
+	}
+
+	log.Printf("starting %s", versionString())
+	log.Printf("subscribing to '%s'\n", subscriptionName)
+	subscription = pubSubClient.Subscription(subscriptionName)
+	if ackAfterProcessing {
+		// keep extending the lease of messages for as long as a job can take
+		subscription.ReceiveSettings.MaxExtension = WORKFLOW_TIMEOUT + shutdownGracePeriod
+	}
+	if maxExtension > 0 {
+		subscription.ReceiveSettings.MaxExtension = maxExtension
+	}
+	if maxOutstandingMessages > 0 {
+		subscription.ReceiveSettings.MaxOutstandingMessages = maxOutstandingMessages
+	}
+
+	// canceling the receive context stops pulling new messages while workers keep running
+	receiveCtx, receiveCancel := context.WithCancel(workerCtx)
+	defer receiveCancel()
+
+	c := shutdownSignal(mainCancel, workerCancel, receiveCancel)
+	p := pauseSignal()
+	defer func() {
+		signal.Stop(c)
+		signal.Stop(p)
+		close(jobs)
+		topic.Stop()
+		if deadLetterTopic != nil {
+			deadLetterTopic.Stop()
+		}
+		if resultTopic != nil {
+			resultTopic.Stop()
+		}
+		pubSubClient.Close()
+	}()
+
+	log.Printf("waiting for messages on '%s'\n", subscriptionName)
+	err = subscription.Receive(receiveCtx, receiveMessage(jobs))
+	if err != nil {
+		log.Fatal("sub.Receive: %w", err)
+	}
+
+	<-mainCtx.Done()
+}
+
+// receiveMessage returns the callback of Receive, which filters the messages and enqueues
+// jobs for the workers
+func receiveMessage(jobs chan<- core.WorkflowContext) func(context.Context, *pubsub.Message) {
+	return func(ctx context.Context, msg *pubsub.Message) {
+		bucketId := msg.Attributes["bucketId"]
+		dstBucketId, ok := destinationBucketFor(bucketId)
+		if !ok {
+			log.Printf("ignoring event - received for bucket '%s' which has no destination bucket configured. Potentially storage notification misconfigured.\n", bucketId)
+			ignoreEvent(msg)
+			return
+		}
+
+		objectId := core.NormalizeObjectName(msg.Attributes["objectId"])
+		if objectId == "" {
+			log.Printf("ignoring event for empty object: %v\n", msg.Attributes)
+			ignoreEvent(msg)
+			return
+		}
+
+		// ingore files containing 'dax-tmp' and temporary parts of parallel compressions
+		if objectId == "" || strings.Contains(objectId, "dax-tmp") || core.IsTempPart(objectId) {
+			log.Printf("ignoring event for temp object: '%s'\n", objectId)
+			ignoreEvent(msg)
+			return
+		}
+
+		// ignore objects outside of the configured prefix
+		if !strings.HasPrefix(objectId, sourcePrefix) {
+			log.Printf("ignoring event for object outside of prefix '%s': '%s'\n", sourcePrefix, objectId)
+			ignoreEvent(msg)
+			return
+		}
+
+		// ignore objects with extensions not included
+		if !core.HasExtension(objectId, extensions) {
+			log.Printf("ignoring event for object with excluded extension: '%s'\n", objectId)
+			ignoreEvent(msg)
+			return
+		}
+
+		// ignore objects written by ourselves when compressing within the same bucket
+		if bucketId == dstBucketId && strings.HasSuffix(objectId, destinationSuffix) && !inPlace {
+			log.Printf("ignoring event for compressed object: '%s'\n", objectId)
+			ignoreEvent(msg)
+			return
+		}
+
+		// ingore events not in the allowlist (e.g. delete)
+		eventType := msg.Attributes["eventType"]
+		if !allowedEventTypes[eventType] {
+			log.Printf("ignoring event of type '%s' for objectId '%s'\n", eventType, objectId)
+			ignoreEvent(msg)
+			return
+		}
+
+		// back off messages that have been republished after a failure
+		if notBefore, err := time.Parse(time.RFC3339, msg.Attributes[NOT_BEFORE_ATTRIBUTE]); err == nil {
+			if delay := time.Until(notBefore); delay > 0 {
+				log.Printf("delaying redelivery %s of '%s' by %s\n", msg.Attributes[REDELIVERY_COUNT_ATTRIBUTE], objectId, delay.Round(time.Second))
+				// the callback holds an outstanding message slot while waiting, so longer
+				// delays are left to the redelivery of the nacked message
+				select {
+				case <-time.After(min(delay, NOT_BEFORE_MAX_WAIT)):
+				case <-ctx.Done():
+					msg.Nack()
+					return
+				}
+				if delay > NOT_BEFORE_MAX_WAIT {
+					msg.Nack()
+					return
+				}
+			}
+		}
+
+		// while paused messages are held without being acked. Their lease is extended by
+		// the client, so they are processed on resume or redelivered after a restart
+		if !waitWhilePaused(ctx) {
+			msg.Nack()
+			return
+		}
+
+		// messages received while shutting down are left for redelivery
+		if !startJob() {
+			msg.Nack()
+			return
+		}
+
+		attributes := copyAttributes(msg.Attributes)
+		if _, ok := attributes[ORIGINAL_PUBLISH_TIME_ATTRIBUTE]; !ok {
+			attributes[ORIGINAL_PUBLISH_TIME_ATTRIBUTE] = msg.PublishTime.UTC().Format(time.RFC3339Nano)
+		}
+
+		job := core.WorkflowContext{
+			ObjectName:                objectId,
+			OriginalMessageAttributes: attributes,
+			OriginalMessageData:       msg.Data,
+		}
+
+		// with -ackAfterProcessing the worker settles the message after processing while
+		// the client extends its lease. Otherwise ack the message once it is enqueued
+		// the max allowed ack deadline for Pubsub is 600s
+		// compressing large files takes than 600s resulting into
+		// potential duplicates if not acked directly
+		if ackAfterProcessing {
+			job.Ack = msg.Ack
+			job.Nack = msg.Nack
+		}
+
+		// stop enqueuing once receiving is canceled. jobs is only closed after Receive
+		// returned, which waits for this callback, so a send never races with the close
+		select {
+		case jobs <- job:
+		case <-ctx.Done():
+			jobsWg.Done()
+			msg.Nack()
+			return
+		}
+		if !ackAfterProcessing {
+			msg.Ack()
+		}
+	}
+}
+
+// compressObject compresses the single object provided via flags
+func compressObject(ctx context.Context) *summary {
+	s := &summary{}
+
+	options := workflowOptions()
+	options.SourceGeneration = sourceGeneration
+
+	wf, err := core.NewWorkflow(ctx, compressionLevel, sourceBucketName, sourceObjectName, destinationBucketName, destinationObjectName, options)
+	if err != nil {
+		log.Printf("error with storage client: %v", err)
+		s.fail()
+		return s
+	}
+	defer wf.Close()
+
+	result, err := wf.Compress(ctx)
+	if errors.Is(err, core.ErrObjectTooSmall) || errors.Is(err, core.ErrObjectEmpty) || errors.Is(err, core.ErrDestinationSkipped) || errors.Is(err, core.ErrLowRatio) || errors.Is(err, core.ErrContentTypeSkipped) || errors.Is(err, core.ErrInPlaceSkipped) || errors.Is(err, core.ErrSourceChanged) {
+		s.skip()
+		return s
+	}
+	if err != nil {
+		log.Printf("error compressing object: %v", err)
+		s.fail()
+		return s
+	}
+
+	err = wf.Delete(ctx)
+	if err != nil {
+		log.Printf("error deleting source object: %v", err)
+		s.fail()
+		return s
+	}
+
+	s.succeed(result)
+	return s
+}
+
+// compressLocal compresses a local file, or stdin, to a local file, or stdout, without
+// accessing GCS. The input file is kept
+func compressLocal(ctx context.Context) *summary {
+	s := &summary{}
+	start := time.Now()
+
+	in := os.Stdin
+	if localInput != "-" {
+		f, err := os.Open(localInput)
+		if err != nil {
+			log.Printf("error opening input: %v", err)
+			s.fail()
+			return s
+		}
+		defer f.Close()
+		in = f
+	}
+
+	out := os.Stdout
+	if localOutput != "-" {
+		f, err := os.Create(localOutput)
+		if err != nil {
+			log.Printf("error creating output: %v", err)
+			s.fail()
+			return s
+		}
+		defer f.Close()
+		out = f
+	}
+
+	w := &countingWriter{w: out}
+	n, err := core.CompressStream(ctx, w, in, codec, compressionLevel, gzipBufferSize)
+	if err == nil && out != os.Stdout {
+		err = out.Close()
+	}
+	if err != nil {
+		log.Printf("error compressing '%s': %v", localInput, err)
+		s.fail()
+		return s
+	}
+
+	result := core.Result{BytesIn: n, BytesOut: w.n, Codec: codec.Name, Duration: time.Since(start)}
+	if w.n > 0 {
+		result.Ratio = float64(n) / float64(w.n)
+	}
+	log.Printf("compressed %d bytes to %d bytes. Compression ratio %.2f. Took %s", result.BytesIn, result.BytesOut, result.Ratio, result.Duration.Round(time.Millisecond))
+	s.succeed(result)
+	return s
+}
+
+// countingWriter counts the bytes written to w
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
 
-	flag.StringVar(&subscriptionName, "subscription", "", "name of the PubSub subscription to listen for storage notifications [event-driven]")
-	flag.StringVar(&topicName, "topic", "", "name of the PubSub topic used to republish messages in case of a shutdown mid-processing [event-driven]")
-	flag.StringVar(&projectId, "projectId", pubsub.DetectProjectID, "Google Cloud project id used for the PubSub client")
-	flag.Parse()
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
 }
 
-func validateFlags() {
-	// check for required values
-	if sourceBucketName == "" || destinationBucketName == "" {
-		fmt.Fprintf(flag.CommandLine.Output(), "error:	-sourceBucket and -destinationBucket are required\n\n")
-		flag.PrintDefaults()
-		os.Exit(1)
-	}
+// decompressObject decompresses the single object provided via flags. The compressed
+// source object is kept
+func decompressObject(ctx context.Context) *summary {
+	s := &summary{}
 
-	// ensure that only one sourceObjectName or subscription is set
-	if (sourceObjectName == "" && subscriptionName == "") || (sourceObjectName != "" && subscriptionName != "") {
-		fmt.Fprintf(flag.CommandLine.Output(), "error:	provide either -sourceObjectName for cli xor -subscription\n\n")
-		flag.PrintDefaults()
-		os.Exit(1)
-	}
+	options := workflowOptions()
+	options.SourceGeneration = sourceGeneration
 
-	if destinationObjectName == "" {
-		destinationObjectName = sourceObjectName
+	wf, err := core.NewWorkflow(ctx, compressionLevel, sourceBucketName, sourceObjectName, destinationBucketName, destinationObjectName, options)
+	if err != nil {
+		log.Printf("error with storage client: %v", err)
+		s.fail()
+		return s
 	}
+	defer wf.Close()
 
-	if sourceBucketName == destinationBucketName && sourceObjectName == destinationObjectName {
-		fmt.Fprintf(flag.CommandLine.Output(),
-			"error:	when using the same -sourceBucket and -destinationBucket, -subscription cannot be used.\n"+
-				"	when using the same -sourceBucket and -destinationBucket, -destinationObjectName must be different from -sourceObjectName\n\n")
-		flag.PrintDefaults()
-		os.Exit(1)
+	result, err := wf.Decompress(ctx)
+	if err != nil {
+		log.Printf("error decompressing object: %v", err)
+		s.fail()
+		return s
 	}
 
-	if subscriptionName != "" && topicName == "" {
-		fmt.Fprintf(flag.CommandLine.Output(), "error:	when usign -subscription -topic needs to be provided.\n\n")
-		flag.PrintDefaults()
-		os.Exit(1)
-	}
+	s.succeed(result)
+	return s
 }
 
-func main() {
-	validateFlags()
-
-	// use two different context to allow to cancel workers and giving them
-	// time to cleanup / republish messages that have not been fully processed
-	mainCtx, mainCancel = context.WithCancel(context.Background())
-	workerCtx, workerCancel := context.WithCancel(mainCtx)
+// bulkObjects compresses each object under the prefix, or matching the glob, provided via
+// flags into its own destination object. Failing objects are counted and do not stop the run
+func bulkObjects(ctx context.Context) *summary {
+	s := &summary{}
+	options := workflowOptions()
 
-	// single file should be compressed
-	if sourceObjectName != "" {
-		wf, err := core.NewWorkflow(mainCtx, compressionLevel, sourceBucketName, sourceObjectName, destinationBucketName, destinationObjectName)
+	var m *manifest
+	if manifestName != "" {
+		var err error
+		m, err = newManifest(ctx, destinationBucketName, manifestName, options.DestinationClientOptions...)
 		if err != nil {
-			log.Fatalf("error with storage client: %v", err)
+			log.Printf("error creating manifest: %v", err)
+			s.fail()
+			return s
 		}
-		defer wf.Close()
+		defer func() {
+			if err := m.close(ctx); err != nil {
+				log.Printf("error: %v", err)
+				s.fail()
+			}
+		}()
+	}
 
-		err = wf.Compress(mainCtx)
-		if err != nil {
-			log.Fatalf("error compressing object: %v", err)
+	// generation is only set for noncurrent versions, otherwise the live version is used
+	list := func(fn func(objectName string, generation int64) error) (int, error) {
+		return core.ListObjects(ctx, sourceBucketName, sourcePrefix, options, func(objectName string) error {
+			return fn(objectName, 0)
+		})
+	}
+	if includeNoncurrent {
+		list = func(fn func(objectName string, generation int64) error) (int, error) {
+			return core.ListNoncurrent(ctx, sourceBucketName, sourcePrefix, options, fn)
 		}
+	}
 
-		err = wf.Delete(mainCtx)
+	// glob matches are collected up front to report their number before starting
+	if sourceGlob != "" {
+		var matches []string
+		skipped, err := core.ListObjects(ctx, sourceBucketName, core.GlobPrefix(sourceGlob), options, func(objectName string) error {
+			if ok, _ := path.Match(sourceGlob, objectName); ok {
+				matches = append(matches, objectName)
+			}
+			return nil
+		})
 		if err != nil {
-			log.Fatalf("error deleting source object: %v", err)
+			log.Printf("error listing objects: %v", err)
+			s.fail()
+			return s
 		}
 
-		return
-	}
+		log.Printf("glob '%s' matched %d objects", sourceGlob, len(matches))
+		if len(matches) == 0 && !allowEmpty {
+			log.Printf("error: glob '%s' matched no objects", sourceGlob)
+			s.fail()
+			return s
+		}
 
-	// event driven
-	pubSubClient, err := pubsub.NewClient(workerCtx, projectId)
-	if err != nil {
-		log.Fatal(err)
+		list = func(fn func(objectName string, generation int64) error) (int, error) {
+			for _, objectName := range matches {
+				if err := fn(objectName, 0); err != nil {
+					return skipped, err
+				}
+			}
+			return skipped, nil
+		}
 	}
 
-	noOfConcurrentJob := runtime.NumCPU() - 1
-	if noOfConcurrentJob <= 0 {
-		noOfConcurrentJob = 1
+	// listed objects take the bulk path rather than the workers of serve, which settle
+	// failures via PubSub
+	if objectList != "" {
+		list = func(fn func(objectName string, generation int64) error) (int, error) {
+			return 0, readObjectList(ctx, objectList, options, func(objectName string) error {
+				return fn(objectName, 0)
+			})
+		}
 	}
 
-	// create a worker pool to paralellize compression
-	jobs := make(chan core.WorkflowContext, noOfConcurrentJob)
-	for w := 1; w <= noOfConcurrentJob; w++ {
-		go worker(workerCtx, w, jobs)
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(workers())
+
+	// failed counts a failed object. Without -continueOnError the error cancels the run,
+	// as does a canceled run context, which is no failure of the object itself
+	failed := func(err error) error {
+		s.fail()
+		if continueOnError && ctx.Err() == nil {
+			return nil
+		}
+		return err
 	}
 
-	log.Printf("topic used for republishing '%s'", topicName)
-	topic = pubSubClient.Topic(topicName)
+	skipped, err := list(func(objectName string, generation int64) error {
+		// stop listing once the run is canceled
+		if err := gctx.Err(); err != nil {
+			return err
+		}
 
-	log.Printf("subscribing to '%s'\n", subscriptionName)
-	subscription = pubSubClient.Subscription(subscriptionName)
+		// ignore objects written by ourselves when compressing within the same bucket
+		if sourceBucketName == destinationBucketName && ((strings.HasSuffix(objectName, destinationSuffix) && !inPlace) || objectName == manifestName) {
+			return nil
+		}
 
-	c := shutdownSignal(mainCancel, workerCancel)
-	defer func() {
-		signal.Stop(c)
-		close(jobs)
-		topic.Stop()
-		pubSubClient.Close()
-	}()
+		g.Go(func() error {
+			// a timed out object is counted as failure while the run continues with other objects
+			octx := gctx
+			if perObjectTimeout > 0 {
+				var ocancel context.CancelFunc
+				octx, ocancel = context.WithTimeout(gctx, perObjectTimeout)
+				defer ocancel()
+			}
 
-	log.Printf("waiting for messages on '%s'\n", subscriptionName)
-	err = subscription.Receive(workerCtx, func(_ context.Context, msg *pubsub.Message) {
-		bucketId := msg.Attributes["bucketId"]
-		if bucketId != sourceBucketName {
-			log.Printf("ignoring event - received for bucket '%s' but expected to get it for bucket '%s'. Potentially storage notification misconfigured.\n", bucketId, sourceBucketName)
-			msg.Ack()
-			return
-		}
+			// a noncurrent version is read, written to a destination keyed by name and
+			// generation and deleted by its generation, so the live version is never touched
+			objectOptions := options
+			dstName := destinationName(objectName)
+			if generation > 0 {
+				objectOptions.SourceGeneration = generation
+				dstName = destinationName(fmt.Sprintf("%s.%d", objectName, generation))
+			}
 
-		objectId := msg.Attributes["objectId"]
-		if objectId == "" {
-			log.Printf("ignoring event for empty object: %v\n", msg.Attributes)
-			msg.Ack()
-			return
-		}
+			wf, err := core.NewWorkflow(octx, compressionLevel, sourceBucketName, objectName, destinationBucketName, dstName, objectOptions)
+			if err != nil {
+				log.Printf("'%s' error with storage client: %v", objectName, err)
+				return failed(err)
+			}
+			defer wf.Close()
 
-		// ingore files containing 'dax-tmp'
-		if objectId == "" || strings.Contains(objectId, "dax-tmp") {
-			log.Printf("ignoring event for temp object: '%s'\n", objectId)
-			msg.Ack()
-			return
-		}
+			result, err := wf.Compress(octx)
+			if errors.Is(err, core.ErrObjectTooSmall) || errors.Is(err, core.ErrObjectEmpty) || errors.Is(err, core.ErrSourceGone) || errors.Is(err, core.ErrDestinationSkipped) || errors.Is(err, core.ErrLowRatio) || errors.Is(err, core.ErrContentTypeSkipped) || errors.Is(err, core.ErrInPlaceSkipped) || errors.Is(err, core.ErrSourceChanged) {
+				s.skip()
+				return nil
+			}
+			if errors.Is(err, context.DeadlineExceeded) && octx.Err() != nil && gctx.Err() == nil {
+				log.Printf("'%s' error compressing object: timed out after %s", objectName, perObjectTimeout)
+				return failed(err)
+			}
+			if err != nil {
+				log.Printf("'%s' error compressing object: %v", objectName, err)
+				return failed(err)
+			}
 
-		// ingore events other than finalize (e.g. delete)
-		eventType := msg.Attributes["eventType"]
-		if eventType != "OBJECT_FINALIZE" {
-			log.Printf("ignoring event of type '%s' for objectId '%s'\n", eventType, objectId)
-			msg.Ack()
-			return
-		}
+			if err := wf.Delete(octx); err != nil {
+				log.Printf("'%s' error deleting source object: %v", objectName, err)
+				return failed(err)
+			}
+			s.succeed(result)
 
-		// write into event into BQ and ack the message directly
-		// the max allowed ack deadline for Pubsub is 600s
-		// compressing large files takes than 600s resulting into
-		// potential duplicates if not acked directly
-		// TODO ensure to write to BQ before we ACK
-		msg.Ack()
-		jobs <- core.WorkflowContext{
-			ObjectName:                objectId,
-			OriginalMessageAttributes: msg.Attributes,
-			OriginalMessageData:       msg.Data,
-		}
+			if m != nil {
+				m.add(ctx, manifestRecord{
+					Source:      objectName,
+					Generation:  generation,
+					Destination: wf.DestinationName(),
+					BytesIn:     result.BytesIn,
+					BytesOut:    result.BytesOut,
+					Ratio:       result.Ratio,
+					Codec:       result.Codec,
+				})
+			}
+			return nil
+		})
+		return nil
 	})
+	gerr := g.Wait()
+
+	for range skipped {
+		s.skip()
+	}
+	if gerr != nil {
+		log.Printf("error: stopped run: %v", gerr)
+	}
+	// listing stops with the canceled context of a stopped run, which is reported above
+	if err != nil && !(gerr != nil && errors.Is(err, context.Canceled)) {
+		log.Printf("error listing objects: %v", err)
+		s.fail()
+	}
+	return s
+}
 
+// archiveObjects archives all objects under the prefix provided via flags
+func archiveObjects(ctx context.Context) *summary {
+	s := &summary{}
+
+	a, err := core.NewArchiver(ctx, compressionLevel, sourceBucketName, sourcePrefix, destinationBucketName, destinationObjectName, workflowOptions())
 	if err != nil {
-		log.Fatal("sub.Receive: %w", err)
+		log.Printf("error with storage client: %v", err)
+		s.fail()
+		return s
 	}
+	defer a.Close()
 
-	<-mainCtx.Done()
+	result, err := a.Archive(ctx)
+	if err != nil {
+		log.Printf("error archiving objects: %v", err)
+		s.fail()
+		return s
+	}
+
+	s.Total += result.Objects + result.Skipped
+	s.Succeeded += result.Objects
+	s.Skipped += result.Skipped
+	s.BytesIn += result.BytesIn
+	s.BytesOut += result.BytesOut
+	return s
 }
 
 func worker(ctx context.Context, id int, jobs <-chan core.WorkflowContext) {
@@ -206,25 +1217,52 @@ func worker(ctx context.Context, id int, jobs <-chan core.WorkflowContext) {
 			ObjectName:                cdata.ObjectName,
 			OriginalMessageAttributes: cdata.OriginalMessageAttributes,
 			OriginalMessageData:       cdata.OriginalMessageData,
+			Ack:                       cdata.Ack,
+			Nack:                      cdata.Nack,
 		}
 
-		log.Printf("%s - '%s' compressing from bucket / '%s' -> bucket '%s' / '%s'", workerName, objectName, sourceBucketName, destinationBucketName, objectName)
+		// republished messages keep the attributes, so the buckets are resolved the same way
+		srcBucket := cdata.OriginalMessageAttributes["bucketId"]
+		dstBucket, _ := destinationBucketFor(srcBucket)
+
+		log.Printf("%s - '%s' compressing from bucket / '%s' -> bucket '%s' / '%s'", workerName, objectName, srcBucket, dstBucket, destinationName(objectName))
 		func() {
+			defer jobsWg.Done()
 
-			lctx, lcancel := context.WithTimeout(context.WithValue(ctx, core.ContextData, newContextData), WORKFLOW_TIMEOUT)
+			// continue the trace of the producer of the message, if any
+			lctx := messageContext(context.WithValue(ctx, core.ContextData, newContextData), cdata.OriginalMessageAttributes)
+			lctx, lcancel := context.WithTimeout(lctx, WORKFLOW_TIMEOUT)
 			defer lcancel()
-			wf, err := core.NewWorkflow(lctx, compressionLevel, sourceBucketName, objectName, destinationBucketName, objectName)
+
+			if err := throttle(lctx); err != nil {
+				handleWorkerError(lctx, "failed waiting for rate limit", err)
+				return
+			}
+
+			job := trackJob(workerName, srcBucket, objectName)
+			defer untrackJob(workerName)
+
+			options := workflowOptions()
+			options.BytesRead = &job.bytesRead
+
+			wf, err := core.NewWorkflow(lctx, compressionLevel, srcBucket, objectName, dstBucket, destinationName(objectName), options)
 			if err != nil {
 				handleWorkerError(lctx, "failed with error with storage client", err)
 				return
 			}
 			defer wf.Close()
 
-			err = wf.Compress(lctx)
+			result, err := compressWithRetries(lctx, wf, objectName)
+			if errors.Is(err, core.ErrObjectTooSmall) || errors.Is(err, core.ErrObjectEmpty) || errors.Is(err, core.ErrSourceGone) || errors.Is(err, core.ErrDestinationSkipped) || errors.Is(err, core.ErrLowRatio) || errors.Is(err, core.ErrContentTypeSkipped) || errors.Is(err, core.ErrInPlaceSkipped) || errors.Is(err, core.ErrSourceChanged) {
+				log.Printf("%s - skipped job for %s: %v\n", workerName, objectName, err)
+				ack(newContextData)
+				return
+			}
 			if err != nil {
 				handleWorkerError(lctx, "failed with error compressing object", err)
 				return
 			}
+			publishResult(srcBucket, wf.DestinationBucket(), objectName, result)
 
 			err = wf.Delete(lctx)
 			if err != nil {
@@ -232,10 +1270,267 @@ func worker(ctx context.Context, id int, jobs <-chan core.WorkflowContext) {
 				return
 			}
 			log.Printf("%s - finished job for %s\n", workerName, objectName)
+			ack(newContextData)
+			if isDraining() {
+				drainedJobs.Add(1)
+			}
 		}()
 	}
 }
 
+// ignoreEvent settles a message the subscriber does not process according to
+// -ignoredEventAction: ack drops it, nack leaves it to other subscribers or redelivery
+func ignoreEvent(msg *pubsub.Message) {
+	if ignoredEventAction == IGNORED_EVENT_NACK {
+		msg.Nack()
+		return
+	}
+	msg.Ack()
+}
+
+// compressWithRetries compresses the object, retrying transient errors up to -workflowRetries
+// times with exponential backoff before the error is handled by republishing or dead-lettering
+func compressWithRetries(ctx context.Context, wf *core.Workflow, objectName string) (core.Result, error) {
+	for attempt := 0; ; attempt++ {
+		result, err := wf.Compress(ctx)
+		if err == nil || attempt >= workflowRetries || core.IsCanceled(err) || !core.IsRetryable(err) {
+			return result, err
+		}
+
+		delay := WORKFLOW_RETRY_BASE_DELAY << attempt
+		log.Printf("%s - '%s' transient error compressing object, retrying in %s (%d/%d): %v", core.GetWorkerName(ctx), objectName, delay, attempt+1, workflowRetries, err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return core.Result{}, ctx.Err()
+		}
+	}
+}
+
+// startJob registers a new job unless the subscriber is shutting down
+func startJob() bool {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+
+	if draining {
+		return false
+	}
+	jobsWg.Add(1)
+	return true
+}
+
+func isDraining() bool {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+
+	return draining
+}
+
+// credentials returns the client options authenticating with -credentialsFile and, if
+// provided, impersonating -impersonateServiceAccount with these or ADC
+func credentials(ctx context.Context) ([]option.ClientOption, error) {
+	var opts []option.ClientOption
+	if credentialsFile != "" {
+		opts = append(opts, option.WithCredentialsFile(credentialsFile))
+	}
+	if impersonateAccount == "" {
+		return opts, nil
+	}
+
+	ts, err := impersonate.CredentialsTokenSource(ctx, impersonate.CredentialsConfig{
+		TargetPrincipal: impersonateAccount,
+		Scopes:          []string{"https://www.googleapis.com/auth/cloud-platform"},
+	}, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to impersonate '%s': %w", impersonateAccount, err)
+	}
+	return []option.ClientOption{option.WithTokenSource(ts)}, nil
+}
+
+// readObjectList calls fn for each object name listed in the local file or gs://bucket/object,
+// one per line. Blank lines and comments starting with # are ignored
+func readObjectList(ctx context.Context, location string, options core.Options, fn func(objectName string) error) error {
+	var r io.ReadCloser
+	if rest, ok := strings.CutPrefix(location, "gs://"); ok {
+		bucketName, objectName, _ := strings.Cut(rest, "/")
+		client, err := storage.NewClient(ctx, options.SourceClientOptions...)
+		if err != nil {
+			return fmt.Errorf("failed to create GCS client: %v", err)
+		}
+		defer client.Close()
+
+		if r, err = client.Bucket(bucketName).UserProject(options.UserProject).Object(objectName).NewReader(ctx); err != nil {
+			return fmt.Errorf("failed to open object list '%s': %w", location, err)
+		}
+	} else {
+		f, err := os.Open(location)
+		if err != nil {
+			return fmt.Errorf("failed to open object list: %w", err)
+		}
+		r = f
+	}
+	defer r.Close()
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		objectName := strings.TrimSpace(scanner.Text())
+		if objectName == "" || strings.HasPrefix(objectName, "#") {
+			continue
+		}
+		if err := fn(objectName); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read object list '%s': %w", location, err)
+	}
+	return nil
+}
+
+// destinationBucketFor returns the destination bucket of objects of the source bucket: the
+// mapped bucket or else the default -destinationBucket. Without -sourceBucket the default
+// applies to all source buckets
+func destinationBucketFor(srcBucket string) (string, bool) {
+	if dst, ok := bucketMapping[srcBucket]; ok {
+		return dst, true
+	}
+	if destinationBucketName != "" && (sourceBucketName == "" || srcBucket == sourceBucketName) {
+		return destinationBucketName, true
+	}
+	return "", false
+}
+
+// destinationBuckets returns all configured destination buckets, including replicas
+func destinationBuckets() []string {
+	var buckets []string
+	if destinationBucketName != "" {
+		buckets = append(buckets, destinationBucketName)
+	}
+	for _, dst := range bucketMapping {
+		if !slices.Contains(buckets, dst) {
+			buckets = append(buckets, dst)
+		}
+	}
+	for _, route := range routes {
+		if !slices.Contains(buckets, route.Bucket) {
+			buckets = append(buckets, route.Bucket)
+		}
+	}
+	return append(buckets, replicaBuckets...)
+}
+
+// cutLast slices s around the last instance of sep
+func cutLast(s, sep string) (before, after string, found bool) {
+	if i := strings.LastIndex(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
+
+// workers returns the number of objects compressed concurrently
+func workers() int {
+	return max(runtime.NumCPU()-1, 1)
+}
+
+// checkDestinationObject only rejects a destination truly identical to the source object,
+// e.g. with an empty -destinationSuffix, unless -inPlace replaces the source, which then
+// needs to be the destination. Without a source object name, e.g. in bulk, nothing is checked
+func checkDestinationObject(srcBucket, srcObject, dstBucket, dstObject string, inPlace bool) error {
+	if srcObject == "" {
+		return nil
+	}
+	same := srcBucket == dstBucket && srcObject == dstObject
+	if inPlace && !same {
+		return errors.New("-inPlace replaces the source object, -destinationObjectName needs to be empty or equal to -sourceObjectName")
+	}
+	if !inPlace && same {
+		return errors.New("when using the same -sourceBucket and -destinationBucket, -destinationObjectName (including -destinationSuffix) must be different from -sourceObjectName")
+	}
+	return nil
+}
+
+// destinationName returns the name of the destination object for a source object. {date}
+// is kept for the workflow to expand it with the creation date of the source object
+func destinationName(objectName string) string {
+	if destinationTemplate != "" {
+		objectName = core.ExpandTemplate(destinationTemplate, objectName, time.Time{})
+	}
+	return objectName + destinationSuffix
+}
+
+// throttle waits until the rate limit allows to start another job
+func throttle(ctx context.Context) error {
+	if limiter == nil {
+		return nil
+	}
+
+	if limiter.Tokens() < 1 {
+		cdata, _ := core.GetContextData(ctx)
+		log.Printf("%s - '%s' throttling, limit of %g objects per second reached", cdata.WorkerName, cdata.ObjectName, maxObjectsPerSecond)
+	}
+	return limiter.Wait(ctx)
+}
+
+// workflowOptions returns the optional workflow settings configured via flags
+func workflowOptions() core.Options {
+	options := core.Options{
+		MinSize:              minSize,
+		MaxSize:              maxSize,
+		CopySmallFiles:       copySmallFiles,
+		SkipEmpty:            skipEmpty,
+		ContentType:          destinationContentType,
+		KMSKeyName:           kmsKey,
+		PredefinedACL:        destinationACL,
+		StorageClass:         storageClass,
+		GzipBufferSize:       gzipBufferSize,
+		ChunkSize:            chunkSize,
+		ParallelChunks:       parallelChunks,
+		DownloadParallelism:  downloadParallelism,
+		Codec:                codec,
+		OmitContentEncoding:  !setContentEncoding,
+		PartitionByDate:      partitionByDate,
+		CopyExtensions:       core.ParseList(copyExtensions),
+		CompressContentTypes: core.ParseList(compressContentTypes),
+		LevelBySize:          sizeLevels,
+		SkipContentTypes:     core.ParseList(skipContentTypes),
+		StoreOriginalSize:    storeOriginalSize,
+		StoreSourceChecksums: storeSourceChecksums,
+		TagProducer:          tagProducer,
+		DeleteOnInflation:    deleteOnInflation,
+		Append:               appendDestination,
+		InPlace:              inPlace,
+		MetadataRoutes:       routes,
+		UserProject:          userProject,
+		OnExisting:           core.ExistingPolicy(onExisting),
+		ReplicaBuckets:       replicaBuckets,
+		NotFoundRetries:      notFoundRetries,
+		NotFoundDelay:        notFoundDelay,
+		TemporaryHold:        temporaryHold,
+		EventBasedHold:       eventBasedHold,
+		CompressEncoded:      !passthroughEncoded,
+		PreserveCustomTime:   preserveCustomTime,
+		GzipHeaderName:       gzipHeaderName,
+		GzipHeaderComment:    gzipHeaderComment,
+		Deterministic:        deterministic,
+		MinRatio:             minRatio,
+		SkipRatio:            !computeRatio,
+		ModifiedAfter:        modifiedAfterTime,
+	}
+
+	// both clients need the credentials, as they are only shared without any client options
+	options.SourceClientOptions = append(options.SourceClientOptions, credentialOptions...)
+	options.DestinationClientOptions = append(options.DestinationClientOptions, credentialOptions...)
+
+	if sourceProject != "" {
+		options.SourceClientOptions = append(options.SourceClientOptions, option.WithQuotaProject(sourceProject))
+	}
+	if destinationProject != "" {
+		options.DestinationClientOptions = append(options.DestinationClientOptions, option.WithQuotaProject(destinationProject))
+	}
+
+	return options
+}
+
 func handleWorkerError(ctx context.Context, errMsg string, cause error) {
 	cdata, err := core.GetContextData(ctx)
 	if err != nil {
@@ -247,23 +1542,160 @@ func handleWorkerError(ctx context.Context, errMsg string, cause error) {
 
 	log.Printf("%s - '%s' %s: %v", workerName, objectName, errMsg, cause)
 
-	if cause == context.Canceled || errors.Unwrap(cause) == context.Canceled {
-		log.Printf("%s - '%s' context canceled. re-publishing message for reprocessing", workerName, objectName)
-		nCtx, _ := context.WithTimeout(mainCtx, 5*time.Second)
-		r := topic.Publish(nCtx, &pubsub.Message{
-			Attributes: cdata.OriginalMessageAttributes,
-			Data:       cdata.OriginalMessageData,
-		})
-		msgId, err := r.Get(nCtx)
-		if err != nil {
-			log.Printf("'%s' - error republishing message on topic: %v", objectName, err)
+	// the message is still leased, so it can be redelivered by PubSub directly
+	if cdata.Nack != nil {
+		// redelivering a non-retryable error fails again, so it is acked like without
+		// -ackAfterProcessing
+		if !core.IsRetryable(cause) {
+			if deadLetterTopic == nil {
+				log.Printf("%s - '%s' error is not retryable, acking message", workerName, objectName)
+			}
+			publishDeadLetter(cdata, fmt.Sprintf("%s: %v", errMsg, cause))
+			cdata.Ack()
 			return
 		}
-		log.Printf("'%s' - republished message with id '%s'", objectName, msgId)
+		log.Printf("%s - '%s' nacking message for redelivery", workerName, objectName)
+		cdata.Nack()
+		return
+	}
+
+	if !core.IsRetryable(cause) {
+		// errors other than cancellation and transient errors are not retried
+		publishDeadLetter(cdata, fmt.Sprintf("%s: %v", errMsg, cause))
+		return
+	}
+
+	redeliveryCount, _ := strconv.Atoi(cdata.OriginalMessageAttributes[REDELIVERY_COUNT_ATTRIBUTE])
+	redeliveryCount++
+
+	if maxRedeliveries > 0 && redeliveryCount > maxRedeliveries {
+		log.Printf("%s - '%s' retryable error. exceeded %d redeliveries", workerName, objectName, maxRedeliveries)
+		publishDeadLetter(cdata, fmt.Sprintf("exceeded %d redeliveries: %v", maxRedeliveries, cause))
+		return
+	}
+
+	attributes := copyAttributes(cdata.OriginalMessageAttributes)
+	attributes[REDELIVERY_COUNT_ATTRIBUTE] = strconv.Itoa(redeliveryCount)
+	attributes[NOT_BEFORE_ATTRIBUTE] = time.Now().Add(redeliveryDelay(redeliveryCount)).Format(time.RFC3339)
+	// continue the trace of the failed attempt on redelivery
+	injectTraceContext(ctx, attributes)
+
+	log.Printf("%s - '%s' retryable error. re-publishing message for reprocessing", workerName, objectName)
+	if err := publish(topic, objectName, attributes, cdata.OriginalMessageData); err != nil {
+		log.Printf("%s - '%s' message lost, the object needs to be reprocessed manually", workerName, objectName)
+		lostJobs.Add(1)
+		return
+	}
+	republishedJobs.Add(1)
+}
+
+// ack acknowledges the message of a job that is settled after processing
+func ack(cdata core.WorkflowContext) {
+	if cdata.Ack != nil {
+		cdata.Ack()
+	}
+}
+
+// publishDeadLetter publishes the original message to the dead-letter topic, if configured,
+// with the failure reason added as attribute to allow for triage
+func publishDeadLetter(cdata core.WorkflowContext, reason string) {
+	if deadLetterTopic == nil {
+		return
+	}
+
+	log.Printf("%s - '%s' publishing message to dead-letter topic", cdata.WorkerName, cdata.ObjectName)
+	attributes := copyAttributes(cdata.OriginalMessageAttributes)
+	attributes[ERROR_ATTRIBUTE] = reason
+	publish(deadLetterTopic, cdata.ObjectName, attributes, cdata.OriginalMessageData)
+}
+
+// publishResult publishes the result of a compression to the result topic, if configured.
+// Publishing is best-effort and does not fail the job
+func publishResult(srcBucket, dstBucket, objectName string, result core.Result) {
+	if resultTopic == nil {
+		return
+	}
+
+	publish(resultTopic, objectName, map[string]string{
+		"sourceBucket":      srcBucket,
+		"destinationBucket": dstBucket,
+		"objectId":          objectName,
+		"bytesIn":           strconv.FormatInt(result.BytesIn, 10),
+		"bytesOut":          strconv.FormatInt(result.BytesOut, 10),
+		"ratio":             strconv.FormatFloat(result.Ratio, 'f', 2, 64),
+		"codec":             result.Codec,
+		"copyReason":        result.CopyReason,
+		"durationMs":        strconv.FormatInt(result.Duration.Milliseconds(), 10),
+	}, nil)
+}
+
+func copyAttributes(attributes map[string]string) map[string]string {
+	c := make(map[string]string, len(attributes)+2)
+	for k, v := range attributes {
+		c[k] = v
+	}
+	return c
+}
+
+// redeliveryDelay returns the exponential backoff delay for the n-th redelivery of a message
+func redeliveryDelay(n int) time.Duration {
+	delay := REDELIVERY_BASE_DELAY
+	for i := 1; i < n && delay < REDELIVERY_MAX_DELAY; i++ {
+		delay *= 2
+	}
+	return min(delay, REDELIVERY_MAX_DELAY)
+}
+
+func publish(t *pubsub.Topic, objectName string, attributes map[string]string, data []byte) error {
+	// publishing is not canceled by the shutdown, which waits for in-flight jobs and so for
+	// their republishes, but bounded by the timeout
+	nCtx, nCancel := context.WithTimeout(context.WithoutCancel(mainCtx), republishTimeout)
+	defer nCancel()
+	r := t.Publish(nCtx, &pubsub.Message{
+		Attributes: attributes,
+		Data:       data,
+	})
+	msgId, err := r.Get(nCtx)
+	if err != nil {
+		log.Printf("'%s' - error publishing message on topic '%s': %v", objectName, t.ID(), err)
+		return err
+	}
+	log.Printf("'%s' - published message with id '%s' on topic '%s'", objectName, msgId, t.ID())
+	return nil
+}
+
+// pauseSignal pauses processing new messages on SIGUSR1 and resumes it on SIGUSR2
+func pauseSignal() chan<- os.Signal {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR1, syscall.SIGUSR2)
+
+	go func() {
+		for sig := range c {
+			paused.Store(sig == syscall.SIGUSR1)
+			if paused.Load() {
+				log.Printf("received signal %v - paused. In-flight jobs finish, new messages are held until SIGUSR2", sig)
+			} else {
+				log.Printf("received signal %v - resumed", sig)
+			}
+		}
+	}()
+
+	return c
+}
+
+// waitWhilePaused blocks while processing is paused. It returns false if ctx is done first
+func waitWhilePaused(ctx context.Context) bool {
+	for paused.Load() {
+		select {
+		case <-time.After(PAUSE_POLL_INTERVAL):
+		case <-ctx.Done():
+			return false
+		}
 	}
+	return true
 }
 
-func shutdownSignal(mainCancel, workerCancel context.CancelFunc) chan<- os.Signal {
+func shutdownSignal(mainCancel, workerCancel, receiveCancel context.CancelFunc) chan<- os.Signal {
 	// catch SIGINT and properly cancel and cleanup
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
@@ -273,11 +1705,37 @@ func shutdownSignal(mainCancel, workerCancel context.CancelFunc) chan<- os.Signa
 		signal.Stop(c)
 		log.Printf("received signal %v", sig)
 
-		// cancel the workers, wait 7s - the docker default timeout before forefully killing is 10s -
-		// to allow for cleanup / republishing of messages
-		log.Printf("canceling all workers and waiting 7s before stopping - issue another signal to kill immediatlely")
+		// stop accepting new jobs and give in-flight jobs the grace period to finish. Jobs still
+		// running afterwards are canceled and republished. The docker default timeout before
+		// forcefully killing is 10s and republishing takes up to -republishTimeout
+		jobsMu.Lock()
+		draining = true
+		jobsMu.Unlock()
+
+		// stop pulling new messages. Acks of messages settled after processing are dropped
+		// once Receive returns, so with -ackAfterProcessing messages keep being pulled and
+		// nacked until the jobs drained
+		if !ackAfterProcessing {
+			receiveCancel()
+		}
+
+		done := make(chan struct{})
+		go func() {
+			jobsWg.Wait()
+			close(done)
+		}()
+
+		log.Printf("waiting up to %s for in-flight jobs to finish - issue another signal to kill immediatlely", shutdownGracePeriod)
+		select {
+		case <-done:
+		case <-time.After(shutdownGracePeriod):
+			log.Printf("grace period elapsed. canceling all workers to republish unfinished jobs")
+			workerCancel()
+			<-done
+		}
+		log.Printf("drained %d jobs, republished %d jobs, lost %d jobs", drainedJobs.Load(), republishedJobs.Load(), lostJobs.Load())
+
 		workerCancel()
-		time.Sleep(7 * time.Second)
 		mainCancel()
 	}()
 
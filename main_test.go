@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/pstest"
+	"github.com/mrbuk/gcs-compressor/core"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func TestCheckDestinationObject(t *testing.T) {
+	tests := []struct {
+		name      string
+		srcBucket string
+		dstBucket string
+		dstObject string
+		suffix    string
+		inPlace   bool
+		wantErr   bool
+	}{
+		{"other bucket, same name", "src", "dst", "data.csv", "", false, false},
+		{"same bucket with suffix", "bucket", "bucket", "data.csv", ".gz", false, false},
+		{"same bucket, other name", "bucket", "bucket", "data.csv.gz", "", false, false},
+		{"same bucket, same name", "bucket", "bucket", "data.csv", "", false, true},
+		{"suffix on a name making it the source", "bucket", "bucket", "data", ".csv", false, true},
+		{"in place", "bucket", "bucket", "data.csv", "", true, false},
+		{"in place with other name", "bucket", "bucket", "data.csv", ".gz", true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// validateFlags appends the suffix before the check
+			err := checkDestinationObject(tt.srcBucket, "data.csv", tt.dstBucket, tt.dstObject+tt.suffix, tt.inPlace)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkDestinationObject returned %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// newTestPubSub returns a fake PubSub server and a client connected to it
+func newTestPubSub(t *testing.T) (*pstest.Server, *pubsub.Client) {
+	t.Helper()
+	srv := pstest.NewServer()
+	t.Cleanup(func() { srv.Close() })
+	client, err := pubsub.NewClient(context.Background(), "project",
+		option.WithEndpoint(srv.Addr),
+		option.WithoutAuthentication(),
+		option.WithGRPCDialOption(grpc.WithTransportCredentials(insecure.NewCredentials())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return srv, client
+}
+
+func TestRepublishKeepsRedeliveryState(t *testing.T) {
+	srv, client := newTestPubSub(t)
+
+	ctx := context.Background()
+	var err error
+	topic, err = client.CreateTopic(ctx, "jobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { topic.Stop(); topic = nil }()
+	mainCtx = ctx
+	republishTimeout = 5 * time.Second
+	maxRedeliveries = 0
+
+	publishTime := "2026-01-02T03:04:05.000000006Z"
+	attributes := map[string]string{
+		"objectId":                      "data.csv",
+		ORIGINAL_PUBLISH_TIME_ATTRIBUTE: publishTime,
+	}
+	for hop := 1; hop <= 2; hop++ {
+		cdata := core.WorkflowContext{
+			WorkerName:                "worker",
+			ObjectName:                "data.csv",
+			OriginalMessageAttributes: attributes,
+			OriginalMessageData:       []byte("payload"),
+		}
+		handleWorkerError(context.WithValue(ctx, core.ContextData, cdata), "failed to compress", context.Canceled)
+
+		messages := srv.Messages()
+		if len(messages) != hop {
+			t.Fatalf("hop %d: got %d published messages, want %d", hop, len(messages), hop)
+		}
+		msg := messages[hop-1]
+		if got, want := msg.Attributes[REDELIVERY_COUNT_ATTRIBUTE], []string{"", "1", "2"}[hop]; got != want {
+			t.Errorf("hop %d: %s is '%s', want '%s'", hop, REDELIVERY_COUNT_ATTRIBUTE, got, want)
+		}
+		if got := msg.Attributes[ORIGINAL_PUBLISH_TIME_ATTRIBUTE]; got != publishTime {
+			t.Errorf("hop %d: %s is '%s', want '%s'", hop, ORIGINAL_PUBLISH_TIME_ATTRIBUTE, got, publishTime)
+		}
+		if string(msg.Data) != "payload" {
+			t.Errorf("hop %d: data is '%s', want 'payload'", hop, msg.Data)
+		}
+		// the next attempt receives the republished message
+		attributes = msg.Attributes
+	}
+}
+
+// TestReceiveStopsEnqueuing cancels Receive while the callback is blocked on a full jobs
+// channel and closes the channel afterwards like serve does. Run with -race
+func TestReceiveStopsEnqueuing(t *testing.T) {
+	srv, client := newTestPubSub(t)
+	ctx := context.Background()
+	topic, err := client.CreateTopic(ctx, "events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer topic.Stop()
+	sub, err := client.CreateSubscription(ctx, "events", pubsub.SubscriptionConfig{Topic: topic})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sourceBucketName, destinationBucketName, destinationSuffix = "src", "dst", ".gz"
+	allowedEventTypes = map[string]bool{"OBJECT_FINALIZE": true}
+	ackAfterProcessing = false
+	defer func() {
+		sourceBucketName, destinationBucketName, destinationSuffix = "", "", ""
+		allowedEventTypes = nil
+	}()
+
+	const published = 20
+	for i := range published {
+		srv.Publish("projects/project/topics/events", nil, map[string]string{
+			"bucketId":  "src",
+			"objectId":  fmt.Sprintf("object-%d.csv", i),
+			"eventType": "OBJECT_FINALIZE",
+		})
+	}
+
+	// a single slow worker keeps the callbacks blocked on the channel
+	jobs := make(chan core.WorkflowContext, 1)
+	received := make(chan int)
+	go func() {
+		n := 0
+		for range jobs {
+			n++
+			time.Sleep(10 * time.Millisecond)
+			jobsWg.Done()
+		}
+		received <- n
+	}()
+
+	receiveCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if err := sub.Receive(receiveCtx, receiveMessage(jobs)); err != nil {
+		t.Fatalf("Receive: %v", err)
+	}
+	close(jobs)
+	n := <-received
+	jobsWg.Wait()
+
+	if n == 0 || n == published {
+		t.Fatalf("%d of %d messages were enqueued, want Receive to be canceled in between", n, published)
+	}
+	acked := 0
+	for _, m := range srv.Messages() {
+		acked += min(m.Acks, 1)
+	}
+	if acked != n {
+		t.Errorf("%d messages were acked, want the %d enqueued ones", acked, n)
+	}
+}
+
+// TestNonRetryableErrorIsAcked fails a leased message with a non-retryable error and
+// no -deadLetterTopic, which must not be nacked and redelivered forever
+func TestNonRetryableErrorIsAcked(t *testing.T) {
+	srv, client := newTestPubSub(t)
+	ctx := context.Background()
+	topic, err := client.CreateTopic(ctx, "events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer topic.Stop()
+	sub, err := client.CreateSubscription(ctx, "events", pubsub.SubscriptionConfig{Topic: topic})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Publish("projects/project/topics/events", []byte("payload"), map[string]string{"objectId": "data.csv"})
+
+	receiveCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	var deliveries atomic.Int32
+	err = sub.Receive(receiveCtx, func(_ context.Context, msg *pubsub.Message) {
+		deliveries.Add(1)
+		cdata := core.WorkflowContext{
+			WorkerName:                "worker",
+			ObjectName:                "data.csv",
+			OriginalMessageAttributes: msg.Attributes,
+			OriginalMessageData:       msg.Data,
+			Ack:                       msg.Ack,
+			Nack:                      msg.Nack,
+		}
+		handleWorkerError(context.WithValue(ctx, core.ContextData, cdata), "failed to compress", core.ErrPermissionDenied)
+	})
+	if err != nil {
+		t.Fatalf("Receive: %v", err)
+	}
+
+	if n := deliveries.Load(); n != 1 {
+		t.Errorf("message was delivered %d times, want once", n)
+	}
+	if m := srv.Messages()[0]; m.Acks != 1 {
+		t.Errorf("message was acked %d times, want once", m.Acks)
+	}
+}
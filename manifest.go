@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/option"
+)
+
+// the manifest is uploaded after this many records or this long after the last upload,
+// so a partial run still leaves a manifest of the objects processed so far
+const (
+	MANIFEST_FLUSH_RECORDS  = 1000
+	MANIFEST_FLUSH_INTERVAL = time.Minute
+)
+
+// manifestRecord describes a processed object in the manifest
+type manifestRecord struct {
+	Source      string  `json:"source"`
+	Generation  int64   `json:"generation,omitempty"`
+	Destination string  `json:"destination"`
+	BytesIn     int64   `json:"bytesIn"`
+	BytesOut    int64   `json:"bytesOut"`
+	Ratio       float64 `json:"ratio"`
+	Codec       string  `json:"codec"`
+}
+
+// manifest collects records as newline-delimited JSON and uploads them as a whole, as
+// GCS objects cannot be appended to
+type manifest struct {
+	client  *storage.Client
+	object  *storage.ObjectHandle
+	records bytes.Buffer
+	pending int
+	flushed time.Time
+
+	// mu guards the records of concurrently processed objects
+	mu sync.Mutex
+	// uploadMu serializes uploads, so a snapshot never replaces a newer one
+	uploadMu sync.Mutex
+}
+
+func newManifest(ctx context.Context, bucketName, objectName string, opts ...option.ClientOption) (*manifest, error) {
+	client, err := storage.NewClient(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCS client: %v", err)
+	}
+	return &manifest{
+		client:  client,
+		object:  client.Bucket(bucketName).Object(objectName),
+		flushed: time.Now(),
+	}, nil
+}
+
+// add appends a record and uploads the manifest if a flush is due
+func (m *manifest) add(ctx context.Context, record manifestRecord) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("error encoding manifest record: %v", err)
+		return
+	}
+
+	m.mu.Lock()
+	m.records.Write(append(data, '\n'))
+	m.pending++
+	due := m.pending >= MANIFEST_FLUSH_RECORDS || time.Since(m.flushed) >= MANIFEST_FLUSH_INTERVAL
+	if due {
+		m.pending = 0
+		m.flushed = time.Now()
+	}
+	m.mu.Unlock()
+
+	// other objects keep adding records while the manifest is uploaded
+	if due {
+		if err := m.flush(ctx); err != nil {
+			log.Printf("error uploading manifest: %v", err)
+		}
+	}
+}
+
+// flush uploads a snapshot of all records collected so far
+func (m *manifest) flush(ctx context.Context) error {
+	m.uploadMu.Lock()
+	defer m.uploadMu.Unlock()
+
+	m.mu.Lock()
+	snapshot := bytes.Clone(m.records.Bytes())
+	m.mu.Unlock()
+
+	w := m.object.NewWriter(ctx)
+	w.ContentType = "application/x-ndjson"
+	if _, err := w.Write(snapshot); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// close uploads the final manifest and releases the client
+func (m *manifest) close(ctx context.Context) error {
+	defer m.client.Close()
+
+	if err := m.flush(ctx); err != nil {
+		return fmt.Errorf("failed to upload manifest '%s/%s': %w", m.object.BucketName(), m.object.ObjectName(), err)
+	}
+	log.Printf("wrote manifest to '%s/%s'", m.object.BucketName(), m.object.ObjectName())
+	return nil
+}
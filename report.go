@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/mrbuk/gcs-compressor/core"
+)
+
+// summary accumulates the outcome of a cli or archive run
+type summary struct {
+	Total     int     `json:"total"`
+	Succeeded int     `json:"succeeded"`
+	Skipped   int     `json:"skipped"`
+	Failed    int     `json:"failed"`
+	BytesIn   int64   `json:"bytesIn"`
+	BytesOut  int64   `json:"bytesOut"`
+	Ratio     float64 `json:"ratio"`
+
+	// mu guards the counters of concurrently processed objects
+	mu sync.Mutex
+}
+
+func (s *summary) succeed(result core.Result) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Total++
+	s.Succeeded++
+	s.BytesIn += result.BytesIn
+	s.BytesOut += result.BytesOut
+}
+
+func (s *summary) skip() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Total++
+	s.Skipped++
+}
+
+func (s *summary) fail() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Total++
+	s.Failed++
+}
+
+// report logs the summary and writes it as JSON to the file, if provided
+func (s *summary) report(file string) {
+	if s.BytesOut > 0 {
+		s.Ratio = float64(s.BytesIn) / float64(s.BytesOut)
+	}
+
+	log.Printf("summary: %d objects - %d succeeded, %d skipped, %d failed", s.Total, s.Succeeded, s.Skipped, s.Failed)
+	log.Printf("summary: compressed %d bytes to %d bytes. Compression ratio %.2f", s.BytesIn, s.BytesOut, s.Ratio)
+
+	if file == "" {
+		return
+	}
+
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		log.Printf("error encoding report: %v", err)
+		return
+	}
+	if err := os.WriteFile(file, append(data, '\n'), 0644); err != nil {
+		log.Printf("error writing report to '%s': %v", file, err)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mrbuk/gcs-compressor/core"
+)
+
+// activeJob is an object a worker is processing
+type activeJob struct {
+	worker  string
+	bucket  string
+	object  string
+	started time.Time
+
+	// bytesRead is advanced by the workflow while the object is read
+	bytesRead atomic.Int64
+}
+
+// jobStatus is an active job as reported by the status endpoint
+type jobStatus struct {
+	Worker    string    `json:"worker"`
+	Bucket    string    `json:"bucket"`
+	Object    string    `json:"object"`
+	Started   time.Time `json:"started"`
+	BytesRead int64     `json:"bytesRead"`
+}
+
+var (
+	activeJobsMu sync.Mutex
+	activeJobs   = make(map[string]*activeJob)
+)
+
+// trackJob registers the object processed by the worker until untrackJob is called
+func trackJob(worker, bucket, object string) *activeJob {
+	job := &activeJob{worker: worker, bucket: bucket, object: object, started: time.Now()}
+
+	activeJobsMu.Lock()
+	defer activeJobsMu.Unlock()
+	activeJobs[worker] = job
+	return job
+}
+
+func untrackJob(worker string) {
+	activeJobsMu.Lock()
+	defer activeJobsMu.Unlock()
+	delete(activeJobs, worker)
+}
+
+// jobStatuses returns the status of the active jobs, the longest running first
+func jobStatuses() []jobStatus {
+	activeJobsMu.Lock()
+	defer activeJobsMu.Unlock()
+
+	jobs := make([]jobStatus, 0, len(activeJobs))
+	for _, job := range activeJobs {
+		jobs = append(jobs, jobStatus{
+			Worker:    job.worker,
+			Bucket:    job.bucket,
+			Object:    job.object,
+			Started:   job.started,
+			BytesRead: job.bytesRead.Load(),
+		})
+	}
+	slices.SortFunc(jobs, func(a, b jobStatus) int { return a.Started.Compare(b.Started) })
+	return jobs
+}
+
+// requireToken rejects requests without the token as bearer token. An empty token allows all
+func requireToken(token string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// statusHandler serves the active jobs as JSON
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"paused": paused.Load(),
+		"jobs":   jobStatuses(),
+	})
+}
+
+// compressRequest is the body of a manual reprocess request
+type compressRequest struct {
+	Bucket string `json:"bucket"`
+	Object string `json:"object"`
+}
+
+// compressHandler enqueues the object of the request like a storage notification and
+// answers 202 with the job id. Failed jobs are republished to -topic like any other
+func compressHandler(jobs chan<- core.WorkflowContext) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req compressRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Bucket == "" || req.Object == "" {
+			http.Error(w, "body needs to be JSON with bucket and object", http.StatusBadRequest)
+			return
+		}
+		if _, ok := destinationBucketFor(req.Bucket); !ok {
+			http.Error(w, fmt.Sprintf("bucket '%s' has no destination bucket configured", req.Bucket), http.StatusBadRequest)
+			return
+		}
+		if paused.Load() || !startJob() {
+			http.Error(w, "processing is paused or shutting down", http.StatusServiceUnavailable)
+			return
+		}
+
+		id := make([]byte, 8)
+		rand.Read(id)
+		jobId := hex.EncodeToString(id)
+
+		job := core.WorkflowContext{
+			ObjectName: req.Object,
+			OriginalMessageAttributes: map[string]string{
+				"bucketId":                      req.Bucket,
+				"objectId":                      req.Object,
+				JOB_ID_ATTRIBUTE:                jobId,
+				ORIGINAL_PUBLISH_TIME_ATTRIBUTE: time.Now().UTC().Format(time.RFC3339Nano),
+			},
+		}
+
+		select {
+		case jobs <- job:
+		case <-r.Context().Done():
+			jobsWg.Done()
+			return
+		}
+
+		log.Printf("enqueued job '%s' for '%s/%s' on request", jobId, req.Bucket, req.Object)
+		writeJSON(w, http.StatusAccepted, map[string]string{"jobId": jobId})
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// serveAdmin serves /status and /compress on addr until ctx is done
+func serveAdmin(ctx context.Context, addr, token string, jobs chan<- core.WorkflowContext) {
+	mux := http.NewServeMux()
+	mux.Handle("GET /status", requireToken(token, http.HandlerFunc(statusHandler)))
+	mux.Handle("POST /compress", requireToken(token, compressHandler(jobs)))
+	server := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	log.Printf("serving /status and /compress on '%s'", addr)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("error serving admin endpoints: %v", err)
+	}
+}
@@ -0,0 +1,38 @@
+#!/bin/sh
+# end-to-end test of compress and delete against fake-gcs-server. Requires docker and curl
+set -e
+
+PORT=${PORT:-4443}
+export STORAGE_EMULATOR_HOST=localhost:$PORT
+API=http://$STORAGE_EMULATOR_HOST/storage/v1
+WORKDIR=$(mktemp -d)
+
+CONTAINER=$(docker run -d --rm -p $PORT:4443 fsouza/fake-gcs-server -scheme http -public-host $STORAGE_EMULATOR_HOST)
+trap 'docker stop $CONTAINER >/dev/null; rm -rf $WORKDIR' EXIT
+until curl -sf $API/b >/dev/null; do sleep 1; done
+
+mkdir -p build
+go build -o build ./...
+
+for bucket in source destination; do
+    curl -sf -X POST -H "Content-Type: application/json" -d "{\"name\":\"$bucket\"}" $API/b >/dev/null
+done
+
+seq 1 100000 > $WORKDIR/data.txt
+curl -sf -X POST --data-binary @$WORKDIR/data.txt -H "Content-Type: text/plain" \
+    "http://$STORAGE_EMULATOR_HOST/upload/storage/v1/b/source/o?uploadType=media&name=data.txt" >/dev/null
+
+./build/gcs-compressor compress -sourceBucket source -sourceObjectName data.txt -destinationBucket destination -destinationSuffix .gz
+
+# request the stored bytes to not depend on transcoding of the emulator
+curl -sf -H "Accept-Encoding: gzip" "$API/b/destination/o/data.txt.gz?alt=media" -o $WORKDIR/data.txt.gz
+gunzip -c $WORKDIR/data.txt.gz | cmp - $WORKDIR/data.txt
+echo "ok: destination decompresses to the source"
+
+if curl -sf $API/b/source/o/data.txt >/dev/null; then
+    echo "error: source object still exists"
+    exit 1
+fi
+echo "ok: source object deleted"
+
+go test -count=1 -run TestEmulator ./core
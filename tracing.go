@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// setupTracing exports spans to the OTLP endpoint, if provided. Without an endpoint
+// the global no-op tracer provider is kept. The returned func flushes pending spans
+func setupTracing(ctx context.Context, endpoint string) (func(context.Context) error, error) {
+	// trace context is propagated via PubSub message attributes
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	if endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "gcs-compressor"))),
+	)
+	otel.SetTracerProvider(tp)
+
+	return tp.Shutdown, nil
+}
+
+// messageContext returns a context carrying the trace context of the message attributes, if any
+func messageContext(ctx context.Context, attributes map[string]string) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(attributes))
+}
+
+// injectTraceContext adds the trace context of ctx to the message attributes, replacing an existing one
+func injectTraceContext(ctx context.Context, attributes map[string]string) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.MapCarrier(attributes))
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// build information set via -ldflags, e.g.
+// -X main.version=0.3 -X main.commit=$(git rev-parse --short HEAD) -X main.date=$(date -u +%Y-%m-%dT%H:%M:%SZ)
+var (
+	version = "dev"
+	commit  = ""
+	date    = ""
+)
+
+// versionString returns the build information. Without -ldflags commit and date are taken
+// from the VCS information embedded by go build, if any
+func versionString() string {
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && commit == "":
+				commit = setting.Value
+			case setting.Key == "vcs.time" && date == "":
+				date = setting.Value
+			}
+		}
+	}
+	return fmt.Sprintf("gcs-compressor %s (commit %s, built %s)", version, valueOrUnknown(commit), valueOrUnknown(date))
+}
+
+func valueOrUnknown(value string) string {
+	if value == "" {
+		return "unknown"
+	}
+	return value
+}